@@ -0,0 +1,71 @@
+package gorbac
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// AuditEntry is a mutation recorded in the audit log.
+type AuditEntry struct {
+	ID        int64
+	Operation string
+	Entity    string
+	EntityID  int64
+	Target    string
+	Actor     string
+	CreatedAt time.Time
+}
+
+// WithActor returns a copy of r recording actor as the author of its mutations in the audit log.
+func (r *Rbac) WithActor(actor string) *Rbac {
+	rbac := r.clone()
+	rbac.actor = actor
+
+	return rbac
+}
+
+// audit records a mutation when Config.Audit is enabled. Target is the other
+// side of an assignment, e.g. the permission of a role, and may be nil.
+func (r Rbac) audit(operation, entity string, entityID int64, target interface{}) error {
+	if !r.auditing {
+		return nil
+	}
+
+	var t sql.NullString
+	if target != nil {
+		t = sql.NullString{String: fmt.Sprint(target), Valid: true}
+	}
+
+	_, err := r.db.Exec("INSERT INTO audit_log (operation, entity, entity_id, target, actor, created_at) VALUES (?,?,?,?,?,?)", operation, entity, entityID, t, r.actor, time.Now())
+
+	return err
+}
+
+// AuditLog returns the recorded mutations, newest first.
+func (r Rbac) AuditLog(limit, offset int) ([]AuditEntry, error) {
+	rows, err := r.db.Query("SELECT id, operation, entity, entity_id, target, actor, created_at FROM audit_log ORDER BY id DESC LIMIT ? OFFSET ?", limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []AuditEntry
+	for rows.Next() {
+		var a AuditEntry
+		var target sql.NullString
+		err := rows.Scan(&a.ID, &a.Operation, &a.Entity, &a.EntityID, &target, &a.Actor, &a.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		a.Target = target.String
+		result = append(result, a)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
@@ -0,0 +1,73 @@
+package gorbac
+
+import "sync"
+
+// pathCache maps resolved paths to their IDs per table. Only successful
+// lookups are cached and a table's entries are dropped whenever paths in it
+// may have changed. A nil *pathCache disables caching.
+type pathCache struct {
+	mu  sync.RWMutex
+	ids map[string]map[string]int64
+
+	// generation changes on every invalidation, lookups that started before
+	// it are not stored.
+	generation uint64
+}
+
+func newPathCache() *pathCache {
+	return &pathCache{ids: make(map[string]map[string]int64)}
+}
+
+func (c *pathCache) get(table, path string) (int64, bool, uint64) {
+	if c == nil {
+		return 0, false, 0
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	id, ok := c.ids[table][path]
+	return id, ok, c.generation
+}
+
+func (c *pathCache) set(table, path string, id int64, generation uint64) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	if c.ids[table] == nil {
+		c.ids[table] = make(map[string]int64)
+	}
+	c.ids[table][path] = id
+}
+
+func (c *pathCache) invalidate(table string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.ids, table)
+	c.generation++
+}
+
+func (c *pathCache) clear() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ids = make(map[string]map[string]int64)
+	c.generation++
+}
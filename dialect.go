@@ -0,0 +1,89 @@
+package gorbac
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Dialect renders the identifiers and placeholders of a query for a database.
+// Queries are written once with ? placeholders and rendered with render.
+// So far the tree inserts of entity.add are rendered, the other queries are MySQL only,
+// which is why only the mysql driver is accepted.
+type Dialect interface {
+	// Quote quotes a table or column name.
+	Quote(identifier string) string
+
+	// Placeholder returns the placeholder of the n-th argument, starting at 1.
+	Placeholder(n int) string
+
+	// Returning returns the clause making an INSERT return column, or "" when
+	// the ID is read from the result instead.
+	Returning(column string) string
+}
+
+// MySQL is the dialect of New and NewFromDSN.
+var MySQL Dialect = mysqlDialect{}
+
+// postgres renders the tree inserts for Postgres, it is not selectable until every query is rendered.
+var postgres Dialect = postgresDialect{}
+
+// ErrUnsupportedDriver is returned by NewFromDSNE for database/sql drivers other than mysql.
+var ErrUnsupportedDriver = errors.New("unsupported driver, only mysql is supported")
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) Quote(identifier string) string {
+	return "`" + strings.Replace(identifier, "`", "``", -1) + "`"
+}
+
+func (mysqlDialect) Placeholder(n int) string {
+	return "?"
+}
+
+func (mysqlDialect) Returning(column string) string {
+	return ""
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) Quote(identifier string) string {
+	return `"` + strings.Replace(identifier, `"`, `""`, -1) + `"`
+}
+
+func (postgresDialect) Placeholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+func (d postgresDialect) Returning(column string) string {
+	return " RETURNING " + d.Quote(column)
+}
+
+// dialectFor returns the dialect of a database/sql driver name.
+func dialectFor(driver string) (Dialect, error) {
+	if driver != "mysql" {
+		return nil, ErrUnsupportedDriver
+	}
+
+	return MySQL, nil
+}
+
+// render replaces the ? placeholders of query with the placeholders of d.
+func render(d Dialect, query string) string {
+	if _, ok := d.(mysqlDialect); ok {
+		return query
+	}
+
+	var b strings.Builder
+	var n int
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString(d.Placeholder(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,54 @@
+package gorbac
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// DryRunError is returned by destructive operations when Config.DryRun is set.
+// It describes what would have been removed, nothing has been changed.
+type DryRunError struct {
+	NodeIDs          []int64
+	RolePermissions  int64
+	OwnerAssignments int64
+}
+
+func (d *DryRunError) Error() string {
+	return fmt.Sprintf("dry run: would remove nodes %v, %d role permissions and %d owner assignments", d.NodeIDs, d.RolePermissions, d.OwnerAssignments)
+}
+
+// DryRunIDs returns the node IDs a destructive operation would have removed in dry run mode.
+// It returns nil when err is not a DryRunError, e.g. when the operation failed or ran for real.
+func DryRunIDs(err error) []int64 {
+	var d *DryRunError
+	if errors.As(err, &d) {
+		return d.NodeIDs
+	}
+
+	return nil
+}
+
+// dryRunRemoval counts the assignments of roleIDs and returns a DryRunError for the removal of nodeIDs.
+func (r Rbac) dryRunRemoval(nodeIDs []int64, roleIDs []int64) error {
+	result := &DryRunError{NodeIDs: nodeIDs}
+	placeholders, args := inClause(roleIDs)
+
+	err := r.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM role_permissions WHERE role_id IN (%s)", placeholders), args...).Scan(&result.RolePermissions)
+	if err != nil {
+		return err
+	}
+
+	for _, owners := range r.extensions {
+		var count int64
+		err := r.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE role_id IN (%s)", owners.Table(), placeholders), args...).Scan(&count)
+		if err != nil {
+			return err
+		}
+		result.OwnerAssignments += count
+	}
+
+	log.Println("gorbac:", result)
+
+	return result
+}
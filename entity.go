@@ -1,6 +1,7 @@
 package gorbac
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -11,18 +12,28 @@ import (
 type entityInternal interface {
 	add(title string, description string, parentID int64) (int64, error)
 	addPath(path string, descriptions []string) (int64, error)
+	addPaths(specs []PathSpec) (int64, error)
+	ensurePath(path string, descriptions []string) (int64, error)
 
 	assign(role RoleInterface, permission PermissionInterface) (int64, error)
 	count() (int64, error)
 	depth(id int64) (int64, error)
 	descendants(absolute bool, id int64) ([]path, error)
+	descendantsFunc(absolute bool, id int64, fn func(path) error) error
+	descendantsToDepth(id int64, maxDepth int64) ([]path, error)
+	descendantsFiltered(id int64, titleLike, descriptionLike string) ([]path, error)
+	leaves(id int64) ([]path, error)
 
 	edit(id int64, title, description string) error
+	rename(id int64, title string) error
+	setDescription(id int64, description string) error
 	unassign(role RoleInterface, permission PermissionInterface) error
 	returnID(entity string) (int64, error)
 	children(id int64) ([]path, error)
 	getDescription(id int64) (string, error)
 	getTitle(id int64) (string, error)
+	get(id int64) (*NodeInfo, error)
+	getMany(ids []int64) (map[int64]path, error)
 
 	getPath(id int64) (string, error)
 	reset(ensure bool) error
@@ -30,29 +41,73 @@ type entityInternal interface {
 
 	pathID(path string) (int64, error)
 	titleID(title string) (int64, error)
+	resolveMany(refs []string) (map[string]int64, error)
 	deleteConditional(id int64) error
 	deleteSubtreeConditional(id int64) error
 	pathConditional(id int64) ([]path, error)
 	parentNode(id int64) (int64, error)
+	parent(id int64) (*path, error)
+	ancestors(id int64) ([]path, error)
+	search(prefix string, limit int) ([]path, error)
+	exists(id int64) (bool, error)
+	ensureRoot() error
+	isAncestor(ancestorID, descendantID int64) (bool, error)
+	subtreeSize(id int64) (int64, error)
+	depthHistogram(id int64) (map[int64]int64, error)
+	raw(id int64) (int64, int64, int64, error)
+	paths() ([]string, error)
 }
 
 type entityHolder interface {
 	getTable() string
 }
 
-// Left column name in sql scheme
-// Right column name in sql scheme
+// Column names of the roles and permissions tables, all queries refer to them
+// through these constants.
 const (
-	Left  string = "lft"
-	Right        = "rght"
+	Left        string = "lft"
+	Right              = "rght"
+	Title              = "title"
+	Description        = "description"
 )
 
 // Error messages for a invalid title name.
 var (
 	ErrTitleNotFound = errors.New("title not found")
 	ErrPathNotFound  = errors.New("path not found")
+	ErrLockTimeout   = errors.New("timeout acquiring lock")
+	ErrNodeNotFound  = errors.New("node not found")
 )
 
+// QueryError wraps a database error with the operation that failed, e.g. "add: Error 1146: ...".
+// Use errors.As or errors.Unwrap to get to the driver error.
+type QueryError struct {
+	Op  string
+	Err error
+}
+
+func (q *QueryError) Error() string {
+	return q.Op + ": " + q.Err.Error()
+}
+
+func (q *QueryError) Unwrap() error {
+	return q.Err
+}
+
+// queryError wraps err in a QueryError, errors that are already wrapped are returned as is.
+func queryError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var q *QueryError
+	if errors.As(err, &q) {
+		return err
+	}
+
+	return &QueryError{Op: op, Err: err}
+}
+
 type entity struct {
 	rbac         *Rbac
 	entityHolder entityHolder
@@ -63,6 +118,25 @@ type path struct {
 	Title       string
 	Description string
 	Depth       int64
+	Path        string
+
+	// AbsoluteDepth is the depth below the root, independent of whether Depth is relative.
+	AbsoluteDepth int64
+}
+
+// PathSpec describes a path to create together with the descriptions of its nodes.
+type PathSpec struct {
+	Path         string
+	Descriptions []string
+}
+
+// NodeInfo holds the details of a single Role or Permission.
+type NodeInfo struct {
+	ID          int64
+	Title       string
+	Description string
+	Depth       int64
+	Path        string
 }
 
 func (e entity) assign(role RoleInterface, permission PermissionInterface) (int64, error) {
@@ -73,70 +147,184 @@ func (e entity) unassign(role RoleInterface, permission PermissionInterface) err
 	return e.rbac.Unassign(role, permission)
 }
 
+// add inserts a node as the last child of parentID. The nested set is shifted in a
+// transaction, the parent row is locked so concurrent inserts are serialized.
 func (e entity) add(title, description string, parentID int64) (int64, error) {
-	e.lock()
-	defer e.unlock()
+	var insertID int64
+	err := e.inTx(func(e entity) error {
+		var err error
+		insertID, err = e.insert(title, description, parentID)
+		return err
+	})
+	if err != nil {
+		return -1, err
+	}
+
+	return insertID, nil
+}
 
+func (e entity) insert(title, description string, parentID int64) (int64, error) {
 	if parentID == 0 {
 		parentID = int64(e.rbac.rootID())
 	}
 
-	var query string
 	var left, right int
 
-	query = fmt.Sprintf("SELECT `%s` AS `right`, `%s` AS `left` FROM %s WHERE id=?", Right, Left, e.entityHolder.getTable())
+	queries := newAddQueries(e.rbac.dialect, e.entityHolder.getTable())
 
-	err := e.rbac.db.QueryRow(query, parentID).Scan(&right, &left)
+	err := e.rbac.db.QueryRow(queries.parent, parentID).Scan(&right, &left)
 	if err != nil {
-		return -1, err
+		return -1, queryError("add", err)
 	}
 
-	query = fmt.Sprintf("UPDATE %s SET %s = %s + 2 WHERE %s >= ?", e.entityHolder.getTable(), Right, Right, Right)
-	_, err = e.rbac.db.Exec(query, right)
+	_, err = e.rbac.db.Exec(queries.shiftRight, right)
 	if err != nil {
-		return -1, err
+		return -1, queryError("add", err)
 	}
 
-	query = fmt.Sprintf("UPDATE %s SET %s = %s + 2 WHERE %s > ?", e.entityHolder.getTable(), Left, Left, Left)
-	_, err = e.rbac.db.Exec(query, right)
+	_, err = e.rbac.db.Exec(queries.shiftLeft, right)
 	if err != nil {
-		return -1, err
+		return -1, queryError("add", err)
+	}
+
+	var insertID int64
+	if queries.returning {
+		err = e.rbac.db.QueryRow(queries.insert, right+1, right, title, description).Scan(&insertID)
+		if err != nil {
+			return -1, queryError("add", err)
+		}
+	} else {
+		res, err := e.rbac.db.Exec(queries.insert, right+1, right, title, description)
+		if err != nil {
+			return -1, queryError("add", err)
+		}
+		insertID, _ = res.LastInsertId()
 	}
 
-	query = fmt.Sprintf("INSERT INTO %s (`%s`, `%s`, `title`, `description`) VALUES (?,?,?,?)", e.entityHolder.getTable(), Right, Left)
-	res, err := e.rbac.db.Exec(query, right+1, right, title, description)
+	err = e.rbac.audit("add", e.entityHolder.getTable(), insertID, nil)
 	if err != nil {
-		return -1, err
+		return -1, queryError("add", err)
 	}
-	insertID, _ := res.LastInsertId()
 
 	return insertID, nil
 }
 
+// addQueries are the queries inserting a node, rendered for a dialect.
+type addQueries struct {
+	parent     string
+	shiftRight string
+	shiftLeft  string
+	insert     string
+	returning  bool
+}
+
+func newAddQueries(d Dialect, table string) addQueries {
+	t, left, right := d.Quote(table), d.Quote(Left), d.Quote(Right)
+
+	return addQueries{
+		parent:     render(d, fmt.Sprintf("SELECT %s, %s FROM %s WHERE id=? FOR UPDATE", right, left, t)),
+		shiftRight: render(d, fmt.Sprintf("UPDATE %s SET %s = %s + 2 WHERE %s >= ?", t, right, right, right)),
+		shiftLeft:  render(d, fmt.Sprintf("UPDATE %s SET %s = %s + 2 WHERE %s > ?", t, left, left, left)),
+		insert: render(d, fmt.Sprintf("INSERT INTO %s (%s, %s, %s, %s) VALUES (?,?,?,?)%s",
+			t, right, left, d.Quote(Title), d.Quote(Description), d.Returning("id"))),
+		returning: d.Returning("id") != "",
+	}
+}
+
 func (e entity) titleID(title string) (int64, error) {
 	var id int64
 
-	query := fmt.Sprintf("SELECT id FROM %s WHERE title=?", e.entityHolder.getTable())
+	query := fmt.Sprintf("SELECT id FROM %s WHERE %s%s", e.entityHolder.getTable(), e.rbac.equals(Title), e.rbac.notDeleted(""))
 	err := e.rbac.db.QueryRow(query, title).Scan(&id)
 	if err != nil {
 		if err != sql.ErrNoRows {
-			return 0, err
+			return 0, queryError("titleID", err)
 		}
-		fmt.Printf("%s", title)
 		return 0, ErrTitleNotFound
 	}
 	return id, nil
 }
 
-func (e entity) lock() {
-	e.rbac.db.Query("LOCK TABLE " + e.entityHolder.getTable())
+// resolveMany resolves titles and paths to IDs. All titles are resolved in one
+// query, paths one by one. References that can't be found are left out.
+func (e entity) resolveMany(refs []string) (map[string]int64, error) {
+	result := make(map[string]int64, len(refs))
+
+	var titles []interface{}
+	byTitle := make(map[string][]string)
+	for _, ref := range refs {
+		if isPath(ref) {
+			id, err := e.pathID(ref)
+			if err == ErrPathNotFound {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			result[ref] = id
+			continue
+		}
+
+		key := ref
+		if e.rbac.caseInsensitive {
+			key = strings.ToLower(ref)
+		}
+		if _, ok := byTitle[key]; !ok {
+			titles = append(titles, key)
+		}
+		byTitle[key] = append(byTitle[key], ref)
+	}
+
+	if len(titles) == 0 {
+		return result, nil
+	}
+
+	column := Title
+	if e.rbac.caseInsensitive {
+		column = "LOWER(" + Title + ")"
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(titles)), ",")
+	query := fmt.Sprintf("SELECT id, %s FROM %s WHERE %s IN (%s)%s ORDER BY id DESC", column, e.entityHolder.getTable(), column, placeholders, e.rbac.notDeleted(""))
+	rows, err := e.rbac.db.Query(query, titles...)
+	if err != nil {
+		return nil, queryError("resolveMany", err)
+	}
+	defer rows.Close()
+
+	// Rows come in descending order, so the lowest ID wins like in titleID.
+	for rows.Next() {
+		var id int64
+		var title string
+		err := rows.Scan(&id, &title)
+		if err != nil {
+			return nil, queryError("resolveMany", err)
+		}
+		for _, ref := range byTitle[title] {
+			result[ref] = id
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, queryError("resolveMany", err)
+	}
+
+	return result, nil
 }
 
-func (e entity) unlock() {
-	e.rbac.db.Query("UNLOCK TABLES")
+// inTx runs fn with an entity bound to a transaction, reusing the running one if any.
+// Tree mutations rely on the row locks of the transaction instead of LOCK TABLES,
+// which would commit a running transaction and doesn't work on a connection pool.
+func (e entity) inTx(fn func(e entity) error) error {
+	return e.rbac.Tx(func(tx *Rbac) error {
+		return fn(entity{rbac: tx, entityHolder: e.entityHolder})
+	})
 }
 
 func (e entity) reset(ensure bool) error {
+	defer e.rbac.paths.invalidate(e.entityHolder.getTable())
+
 	var err error
 
 	if !ensure {
@@ -145,22 +333,60 @@ func (e entity) reset(ensure bool) error {
 
 	_, err = e.rbac.db.Exec(fmt.Sprintf("DELETE FROM %s", e.entityHolder.getTable()))
 	if err != nil {
-		return err
+		return queryError("reset", err)
 	}
 
 	_, err = e.rbac.db.Exec(fmt.Sprintf("ALTER TABLE %s AUTO_INCREMENT=1;", e.entityHolder.getTable()))
 	if err != nil {
-		return err
+		return queryError("reset", err)
 	}
 
-	_, err = e.rbac.db.Exec(fmt.Sprintf("INSERT INTO %s (Title, Description, Lft, Rght) Values(?,?,?,?)", e.entityHolder.getTable()), "root", "root", 0, 1)
+	_, err = e.rbac.db.Exec(fmt.Sprintf("INSERT INTO %s (%s, %s, %s, %s) Values(?,?,?,?)", e.entityHolder.getTable(), Title, Description, Left, Right), e.rbac.rootTitle, e.rbac.rootTitle, 0, 1)
 	if err != nil {
-		return err
+		return queryError("reset", err)
 	}
 
 	return nil
 }
 
+// ensureRoot inserts the root node when it is missing. Existing nodes are moved
+// below it by rebuilding the tree, an empty table just gets the root.
+func (e entity) ensureRoot() error {
+	exists, err := e.exists(e.rbac.rootID())
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	var left, right sql.NullInt64
+	query := fmt.Sprintf("SELECT MIN(%s), MAX(%s) FROM %s", Left, Right, e.entityHolder.getTable())
+	err = e.rbac.db.QueryRow(query).Scan(&left, &right)
+	if err != nil {
+		return queryError("ensureRoot", err)
+	}
+
+	rootLeft, rootRight := int64(0), int64(1)
+	if left.Valid {
+		rootLeft, rootRight = left.Int64-1, right.Int64+1
+	}
+
+	query = fmt.Sprintf("INSERT INTO %s (id, %s, %s, %s, %s) VALUES (?,?,?,?,?)", e.entityHolder.getTable(), Title, Description, Left, Right)
+	_, err = e.rbac.db.Exec(query, e.rbac.rootID(), e.rbac.rootTitle, e.rbac.rootTitle, rootLeft, rootRight)
+	if err != nil {
+		return queryError("ensureRoot", err)
+	}
+
+	defer e.rbac.paths.invalidate(e.entityHolder.getTable())
+
+	if !left.Valid {
+		return nil
+	}
+
+	return e.rbac.RebuildTree(e.entityHolder.getTable())
+}
+
 func (e entity) resetAssignments(ensure bool) error {
 	var err error
 	if !ensure {
@@ -169,40 +395,113 @@ func (e entity) resetAssignments(ensure bool) error {
 
 	_, err = e.rbac.db.Exec("DELETE FROM role_permissions")
 	if err != nil {
-		return err
+		return queryError("resetAssignments", err)
 	}
 
 	_, err = e.rbac.db.Exec("ALTER TABLE role_permissions AUTO_INCREMENT =1")
 	if err != nil {
-		return err
+		return queryError("resetAssignments", err)
 	}
 
-	e.assign(e.rbac.rootID(), e.rbac.rootID())
+	if !e.rbac.seedRoot {
+		return nil
+	}
 
-	return nil
+	_, err = e.assign(e.rbac.rootID(), e.rbac.rootID())
+
+	return err
+}
+
+// isPath reports whether an entity reference is a path rather than a title.
+// Paths always start with a slash, anything else is treated as a title.
+func isPath(entity string) bool {
+	return strings.HasPrefix(entity, "/")
+}
+
+// titleConcat is the SQL expression concatenating the titles of the ancestors
+// of a node into a path, slashes and backslashes in titles are escaped.
+var titleConcat = fmt.Sprintf(`GROUP_CONCAT(REPLACE(REPLACE(parent.%s, '\\', '\\\\'), '/', '\\/') ORDER BY parent.%s ASC SEPARATOR '/')`, Title, Left)
+
+var titleEscaper = strings.NewReplacer(`\`, `\\`, `/`, `\/`)
+
+// escapeTitle escapes a title so it can be used as a single path segment.
+func escapeTitle(title string) string {
+	return titleEscaper.Replace(title)
+}
+
+// splitPath splits a path on every unescaped slash and unescapes the segments.
+func splitPath(path string) []string {
+	var parts []string
+	var part []rune
+	var escaped bool
+	for _, c := range path {
+		switch {
+		case escaped:
+			part = append(part, c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '/':
+			parts = append(parts, string(part))
+			part = part[:0]
+		default:
+			part = append(part, c)
+		}
+	}
+
+	return append(parts, string(part))
+}
+
+// rootedPath converts an absolute path like "/admin/test" into the form the
+// titles of a node and its ancestors are concatenated to, "root/admin/test"
+// for a root titled "root".
+// Trailing slashes are ignored and "/" refers to the root itself.
+func rootedPath(rootTitle, path string) string {
+	path = strings.TrimRight(path, "/")
+	if path == "" {
+		return escapeTitle(rootTitle)
+	}
+
+	if !isPath(path) {
+		path = "/" + path
+	}
+
+	return escapeTitle(rootTitle) + path
 }
 
 func (e entity) pathID(path string) (int64, error) {
 	var parts []string
-	path = "root" + path
+	path = rootedPath(e.rbac.rootTitle, path)
 
-	if path[len(path)-1:] == "/" {
-		path = path[:len(path)-1]
+	key := path
+	if e.rbac.caseInsensitive {
+		key = strings.ToLower(key)
+	}
+
+	// Transactions bypass the cache, they may see changes that are never committed.
+	var generation uint64
+	if e.rbac.tx == nil {
+		var id int64
+		var ok bool
+		id, ok, generation = e.rbac.paths.get(e.entityHolder.getTable(), key)
+		if ok {
+			return id, nil
+		}
 	}
 
-	parts = strings.Split(path, "/")
+	parts = splitPath(path)
 
 	var query = fmt.Sprintf(`
 		SELECT 
-			node.ID, GROUP_CONCAT(parent.Title ORDER BY parent.Lft ASC SEPARATOR '/') AS path 
+			node.ID, %s AS path 
 		FROM 
 			%s AS node,
 			%s AS parent
 		WHERE 
 			node.%s BETWEEN parent.%s And parent.%s
-		AND  node.Title=?
+		AND  %s%s
 		GROUP BY node.ID
-		HAVING path = ?`, e.entityHolder.getTable(), e.entityHolder.getTable(), Left, Left, Right)
+		HAVING %s`, titleConcat, e.entityHolder.getTable(), e.entityHolder.getTable(), Left, Left, Right, e.rbac.equals("node."+Title), e.rbac.notDeleted("node"), e.rbac.equals("path"))
 
 	var id int64
 
@@ -210,16 +509,70 @@ func (e entity) pathID(path string) (int64, error) {
 	err := e.rbac.db.QueryRow(query, parts[len(parts)-1], path).Scan(&id, &x)
 	if err != nil {
 		if err != sql.ErrNoRows {
-			return 0, err
+			return 0, queryError("pathID", err)
 		}
 		return 0, ErrPathNotFound
 	}
 
+	if e.rbac.tx == nil {
+		e.rbac.paths.set(e.entityHolder.getTable(), key, id, generation)
+	}
+
 	return id, nil
 }
 
+// inClause returns the placeholders and arguments for an IN (...) clause.
+func inClause(ids []int64) (string, []interface{}) {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	return strings.TrimSuffix(strings.Repeat("?,", len(ids)), ","), args
+}
+
+// concatPath converts a GROUP_CONCAT of titles starting at the root into a path.
+func concatPath(titles string) string {
+	var escaped bool
+	for i, c := range titles {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '/':
+			return titles[i:]
+		}
+	}
+
+	return "/"
+}
+
 func (e entity) addPath(path string, descriptions []string) (int64, error) {
-	if path[:1] != "/" {
+	return e.addPathResolved(path, descriptions, make(map[string]int64))
+}
+
+// addPaths creates the missing nodes of all paths. The IDs of the nodes on the way
+// are remembered across the paths, so a shared prefix is only looked up once.
+func (e entity) addPaths(specs []PathSpec) (int64, error) {
+	resolved := make(map[string]int64)
+
+	var nodesCreated int64
+	for _, spec := range specs {
+		n, err := e.addPathResolved(spec.Path, spec.Descriptions, resolved)
+		nodesCreated += n
+		if err != nil {
+			return nodesCreated, err
+		}
+	}
+
+	return nodesCreated, nil
+}
+
+// addPathResolved creates the missing nodes of path, resolved maps the paths
+// already known to their IDs and is updated with the nodes on the way.
+func (e entity) addPathResolved(path string, descriptions []string, resolved map[string]int64) (int64, error) {
+	if !isPath(path) {
 		return 0, fmt.Errorf("The path supplied is not valid.")
 	}
 
@@ -228,130 +581,306 @@ func (e entity) addPath(path string, descriptions []string) (int64, error) {
 
 	var nodesCreated int64
 	var currentPath string
-	var pathID int64
-	var parentID int64
+	var missing bool
+	var parentID = e.rbac.rootID()
 
 	path = path[1:]
-	parts = strings.Split(path, "/")
+	parts = splitPath(path)
 
-	var description string
 	for i, part := range parts {
+		var description string
 		if len(descriptions) > i {
 			description = descriptions[i]
 		}
-		currentPath += "/" + part
+		currentPath += "/" + escapeTitle(part)
 
-		pathID, err = e.pathID(currentPath)
-		if err != ErrPathNotFound {
-			return nodesCreated, err
+		key := currentPath
+		if e.rbac.caseInsensitive {
+			key = strings.ToLower(key)
+		}
+
+		if id, ok := resolved[key]; ok {
+			parentID = id
+			continue
 		}
 
-		if pathID == 0 {
+		// Below a missing node everything is missing, only the first one is looked up.
+		if !missing {
+			var pathID int64
+			pathID, err = e.pathID(currentPath)
+			if err != nil && err != ErrPathNotFound {
+				return nodesCreated, err
+			}
+
+			missing = err == ErrPathNotFound
+			if !missing {
+				parentID = pathID
+			}
+		}
+
+		// Only the missing tail of the path is created, existing nodes become the parent.
+		if missing {
 			parentID, err = e.add(part, description, parentID)
 			if err != nil {
 				return nodesCreated, err
 			}
 
 			nodesCreated++
-		} else {
-			parentID = pathID
 		}
+
+		resolved[key] = parentID
 	}
 
 	return nodesCreated, nil
 }
 
+// ensurePath returns the ID of the node at path, creating the missing nodes first.
+// Concurrent callers are serialized with a named lock so a path is only created once,
+// ErrLockTimeout is returned when the lock is not acquired within the QueryTimeout.
+func (e entity) ensurePath(path string, descriptions []string) (int64, error) {
+	ctx := context.Background()
+	conn, err := e.rbac.pool.Conn(ctx)
+	if err != nil {
+		return 0, queryError("ensurePath", err)
+	}
+	defer conn.Close()
+
+	lockName := "gorbac_" + e.entityHolder.getTable()
+
+	lockCtx, cancel := e.rbac.withTimeout(ctx)
+	defer cancel()
+
+	var locked sql.NullInt64
+	err = conn.QueryRowContext(lockCtx, "SELECT GET_LOCK(?, ?)", lockName, e.rbac.lockWait()).Scan(&locked)
+	if err != nil {
+		return 0, queryError("ensurePath", err)
+	}
+	if locked.Int64 != 1 {
+		return 0, ErrLockTimeout
+	}
+	defer conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", lockName)
+
+	id, err := e.pathID(path)
+	if err != ErrPathNotFound {
+		return id, err
+	}
+
+	_, err = e.addPath(path, descriptions)
+	if err != nil {
+		return 0, err
+	}
+
+	return e.pathID(path)
+}
+
+// count returns the number of nodes, not counting the synthetic root.
 func (e entity) count() (int64, error) {
 	var result int64
-	err := e.rbac.db.QueryRow("SELECT COUNT(*) FROM %s", e.entityHolder.getTable()).Scan(&result)
-	return result, err
+	err := e.rbac.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE id<>?%s", e.entityHolder.getTable(), e.rbac.notDeleted("")), e.rbac.rootID()).Scan(&result)
+	return result, queryError("count", err)
 }
 
 func (e entity) deleteConditional(id int64) error {
+	defer e.rbac.paths.invalidate(e.entityHolder.getTable())
+
+	if e.rbac.soft {
+		err := e.softDelete(id, false)
+		if err != nil {
+			return err
+		}
+		return queryError("remove", e.rbac.audit("remove", e.entityHolder.getTable(), id, nil))
+	}
+
+	return e.inTx(func(e entity) error {
+		return e.deleteNode(id)
+	})
+}
+
+func (e entity) deleteNode(id int64) error {
 	var left, right int64
 	query := fmt.Sprintf(`SELECT %s, %s
 		FROM %s 
-	WHERE ID=? LIMIT 1`, Left, Right, e.entityHolder.getTable())
+	WHERE ID=? LIMIT 1 FOR UPDATE`, Left, Right, e.entityHolder.getTable())
 
 	err := e.rbac.db.QueryRow(query, id).Scan(&left, &right)
 	if err != nil {
-		return err
+		return queryError("remove", err)
 	}
 
 	_, err = e.rbac.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s = ?", e.entityHolder.getTable(), Left), left)
 	if err != nil {
-		return err
+		return queryError("remove", err)
 	}
 
 	query = fmt.Sprintf("UPDATE %s SET %s = %s -1, %s = %s -1 WHERE %s BETWEEN ? AND ?", e.entityHolder.getTable(), Right, Right, Left, Left, Left)
-	_, err = e.rbac.db.Query(query, left, right)
+	_, err = e.rbac.db.Exec(query, left, right)
 	if err != nil {
-		return err
+		return queryError("remove", err)
 	}
 
 	query = fmt.Sprintf("UPDATE %s SET %s = %s -2 WHERE %s > ?", e.entityHolder.getTable(), Right, Right, Right)
 	_, err = e.rbac.db.Exec(query, right)
 	if err != nil {
-		fmt.Println(err)
-		return err
+		return queryError("remove", err)
 	}
 
 	query = fmt.Sprintf("UPDATE %s SET %s = %s -2 WHERE %s > ?", e.entityHolder.getTable(), Left, Left, Left)
-	_, err = e.rbac.db.Query(query, right)
+	_, err = e.rbac.db.Exec(query, right)
 	if err != nil {
-		return err
+		return queryError("remove", err)
 	}
 
-	return nil
+	return queryError("remove", e.rbac.audit("remove", e.entityHolder.getTable(), id, nil))
 }
 
 func (e entity) deleteSubtreeConditional(id int64) error {
+	defer e.rbac.paths.invalidate(e.entityHolder.getTable())
+
+	if e.rbac.soft {
+		err := e.softDelete(id, true)
+		if err != nil {
+			return err
+		}
+		return queryError("removeSubtree", e.rbac.audit("remove_subtree", e.entityHolder.getTable(), id, nil))
+	}
+
+	return e.inTx(func(e entity) error {
+		return e.deleteSubtree(id)
+	})
+}
+
+func (e entity) deleteSubtree(id int64) error {
 	var left, right, width int64
 	query := fmt.Sprintf(`SELECT %s, %s, %s-%s+1 as Width
 		FROM %s 
-	WHERE ID=? LIMIT 1`, Left, Right, Right, Left, e.entityHolder.getTable())
+	WHERE ID=? LIMIT 1 FOR UPDATE`, Left, Right, Right, Left, e.entityHolder.getTable())
 
 	err := e.rbac.db.QueryRow(query, id).Scan(&left, &right, &width)
 	if err != nil {
-		return err
+		return queryError("removeSubtree", err)
 	}
 
 	query = fmt.Sprintf("DELETE FROM %s WHERE %s BETWEEN ? AND ?", e.entityHolder.getTable(), Left)
-	_, err = e.rbac.db.Query(query, right)
+	_, err = e.rbac.db.Exec(query, left, right)
 	if err != nil {
-		return err
+		return queryError("removeSubtree", err)
 	}
 
 	query = fmt.Sprintf("UPDATE %s SET %s = %s - ? WHERE %s > ?", e.entityHolder.getTable(), Right, Right, Right)
-	_, err = e.rbac.db.Query(query, width, right)
+	_, err = e.rbac.db.Exec(query, width, right)
 	if err != nil {
-		return err
+		return queryError("removeSubtree", err)
 	}
 
 	query = fmt.Sprintf("UPDATE %s SET %s = %s - ? WHERE %s > ?", e.entityHolder.getTable(), Left, Left, Left)
-	_, err = e.rbac.db.Query(query, width, right)
+	_, err = e.rbac.db.Exec(query, width, right)
 	if err != nil {
-		return err
+		return queryError("removeSubtree", err)
 	}
 
-	return nil
+	return queryError("removeSubtree", e.rbac.audit("remove_subtree", e.entityHolder.getTable(), id, nil))
+}
+
+// softDelete marks a node, and with recursive all its descendants, as deleted.
+// The nested set is left untouched, descendants that are kept keep their path.
+func (e entity) softDelete(id int64, recursive bool) error {
+	var left, right int64
+	query := fmt.Sprintf("SELECT %s, %s FROM %s WHERE id=?", Left, Right, e.entityHolder.getTable())
+	err := e.rbac.db.QueryRow(query, id).Scan(&left, &right)
+	if err != nil {
+		return queryError("softDelete", err)
+	}
+
+	if !recursive {
+		right = left
+	}
+
+	query = fmt.Sprintf("UPDATE %s SET deleted_at=NOW() WHERE %s BETWEEN ? AND ? AND deleted_at IS NULL", e.entityHolder.getTable(), Left)
+	_, err = e.rbac.db.Exec(query, left, right)
+
+	return queryError("softDelete", err)
 }
 
 func (e entity) getDescription(id int64) (string, error) {
-	var result string
-	err := e.rbac.db.QueryRow(fmt.Sprintf("SELECT description FROM %s WHERE id=?", e.entityHolder.getTable()), id).Scan(&result)
+	var result sql.NullString
+	err := e.rbac.db.QueryRow(fmt.Sprintf("SELECT %s FROM %s WHERE id=?", Description, e.entityHolder.getTable()), id).Scan(&result)
 	if err != nil {
-		return "", err
+		if err == sql.ErrNoRows {
+			return "", ErrNodeNotFound
+		}
+		return "", queryError("getDescription", err)
 	}
 
-	return result, nil
+	return result.String, nil
 }
 
 func (e entity) getTitle(id int64) (string, error) {
 	var result string
-	err := e.rbac.db.QueryRow(fmt.Sprintf("SELECT title FROM %s WHERE id=?", e.entityHolder.getTable()), id).Scan(&result)
+	err := e.rbac.db.QueryRow(fmt.Sprintf("SELECT %s FROM %s WHERE id=?", Title, e.entityHolder.getTable()), id).Scan(&result)
 	if err != nil {
-		return "", err
+		if err == sql.ErrNoRows {
+			return "", ErrNodeNotFound
+		}
+		return "", queryError("getTitle", err)
+	}
+
+	return result, nil
+}
+
+func (e entity) get(id int64) (*NodeInfo, error) {
+	query := fmt.Sprintf(`
+		SELECT
+			node.ID, node.%s, node.%s, COUNT(parent.ID)-1 AS Depth,
+			%s AS Path
+		FROM %s AS node,
+			%s AS parent
+		WHERE node.%s BETWEEN parent.%s AND parent.%s
+		AND ( node.id=? )%s
+		GROUP BY node.ID`, Title, Description, titleConcat, e.entityHolder.getTable(), e.entityHolder.getTable(), Left, Left, Right, e.rbac.notDeleted("node"))
+
+	var result NodeInfo
+	var description sql.NullString
+	err := e.rbac.db.QueryRow(query, id).Scan(&result.ID, &result.Title, &description, &result.Depth, &result.Path)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNodeNotFound
+		}
+		return nil, queryError("get", err)
+	}
+	result.Description = description.String
+	result.Path = concatPath(result.Path)
+
+	return &result, nil
+}
+
+func (e entity) getMany(ids []int64) (map[int64]path, error) {
+	result := make(map[int64]path, len(ids))
+	if len(ids) == 0 {
+		return result, nil
+	}
+
+	placeholders, args := inClause(ids)
+	query := fmt.Sprintf("SELECT id, %s, %s FROM %s WHERE id IN (%s)%s", Title, Description, e.entityHolder.getTable(), placeholders, e.rbac.notDeleted(""))
+	rows, err := e.rbac.db.Query(query, args...)
+	if err != nil {
+		return nil, queryError("getMany", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p path
+		var description sql.NullString
+		err := rows.Scan(&p.ID, &p.Title, &description)
+		if err != nil {
+			return nil, queryError("getMany", err)
+		}
+		p.Description = description.String
+		result[p.ID] = p
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, queryError("getMany", err)
 	}
 
 	return result, nil
@@ -372,7 +901,7 @@ func (e entity) getPath(id int64) (string, error) {
 		if i == 0 {
 			continue
 		}
-		output += "/" + r.Title
+		output += "/" + escapeTitle(r.Title)
 	}
 
 	return output, nil
@@ -380,16 +909,16 @@ func (e entity) getPath(id int64) (string, error) {
 
 func (e entity) pathConditional(id int64) ([]path, error) {
 	query := fmt.Sprintf(`
-		SELECT parent.ID, parent.Title
+		SELECT parent.ID, parent.%s
 		FROM %s AS node,
 			%s AS parent
 		WHERE node.%s BETWEEN parent.%s AND parent.%s
 		AND ( node.id=? )
-		ORDER BY parent.%s`, e.entityHolder.getTable(), e.entityHolder.getTable(), Left, Left, Right, Left)
+		ORDER BY parent.%s`, Title, e.entityHolder.getTable(), e.entityHolder.getTable(), Left, Left, Right, Left)
 
 	rows, err := e.rbac.db.Query(query, id)
 	if err != nil {
-		return nil, err
+		return nil, queryError("path", err)
 	}
 	defer rows.Close()
 
@@ -399,11 +928,20 @@ func (e entity) pathConditional(id int64) ([]path, error) {
 		var title string
 		err := rows.Scan(&id, &title)
 		if err != nil {
-			return nil, err
+			return nil, queryError("path", err)
 		}
 		result = append(result, path{ID: id, Title: title})
 	}
 
+	err = rows.Err()
+	if err != nil {
+		return nil, queryError("path", err)
+	}
+
+	if len(result) == 0 {
+		return nil, ErrNodeNotFound
+	}
+
 	return result, nil
 }
 
@@ -417,13 +955,37 @@ func (e entity) depth(id int64) (int64, error) {
 }
 
 func (e entity) edit(id int64, title, description string) error {
-	query := fmt.Sprintf("UPDATE %s SET title=?, description=? WHERE id=?", e.entityHolder.getTable())
+	defer e.rbac.paths.invalidate(e.entityHolder.getTable())
+
+	query := fmt.Sprintf("UPDATE %s SET %s=?, %s=? WHERE id=?", e.entityHolder.getTable(), Title, Description)
 	_, err := e.rbac.db.Exec(query, title, description, id)
 	if err != nil {
-		return err
+		return queryError("edit", err)
 	}
 
-	return nil
+	return queryError("edit", e.rbac.audit("edit", e.entityHolder.getTable(), id, nil))
+}
+
+func (e entity) rename(id int64, title string) error {
+	defer e.rbac.paths.invalidate(e.entityHolder.getTable())
+
+	query := fmt.Sprintf("UPDATE %s SET %s=? WHERE id=?", e.entityHolder.getTable(), Title)
+	_, err := e.rbac.db.Exec(query, title, id)
+	if err != nil {
+		return queryError("rename", err)
+	}
+
+	return queryError("rename", e.rbac.audit("rename", e.entityHolder.getTable(), id, nil))
+}
+
+func (e entity) setDescription(id int64, description string) error {
+	query := fmt.Sprintf("UPDATE %s SET %s=? WHERE id=?", e.entityHolder.getTable(), Description)
+	_, err := e.rbac.db.Exec(query, description, id)
+	if err != nil {
+		return queryError("setDescription", err)
+	}
+
+	return queryError("setDescription", e.rbac.audit("set_description", e.entityHolder.getTable(), id, nil))
 }
 
 func (e entity) parentNode(id int64) (int64, error) {
@@ -439,10 +1001,183 @@ func (e entity) parentNode(id int64) (int64, error) {
 	return res[len(res)-2].ID, nil
 }
 
+func (e entity) parent(id int64) (*path, error) {
+	res, err := e.pathConditional(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res) < 2 {
+		return nil, nil
+	}
+
+	result := res[len(res)-2]
+	result.Depth = int64(len(res) - 2)
+
+	return &result, nil
+}
+
+func (e entity) ancestors(id int64) ([]path, error) {
+	res, err := e.pathConditional(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res) < 2 {
+		return nil, nil
+	}
+
+	return res[:len(res)-1], nil
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// EscapeLike escapes the LIKE wildcards in s so it only matches itself.
+func EscapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+func (e entity) search(prefix string, limit int) ([]path, error) {
+	query := fmt.Sprintf("SELECT id, %s, %s FROM %s WHERE %s LIKE ?%s ORDER BY %s LIMIT ?", Title, Description, e.entityHolder.getTable(), Title, e.rbac.notDeleted(""), Title)
+	rows, err := e.rbac.db.Query(query, EscapeLike(prefix)+"%", limit)
+	if err != nil {
+		return nil, queryError("search", err)
+	}
+	defer rows.Close()
+
+	var result []path
+	for rows.Next() {
+		var p path
+		var description sql.NullString
+		err := rows.Scan(&p.ID, &p.Title, &description)
+		if err != nil {
+			return nil, queryError("search", err)
+		}
+		p.Description = description.String
+		result = append(result, p)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, queryError("search", err)
+	}
+
+	return result, nil
+}
+
+func (e entity) exists(id int64) (bool, error) {
+	var result int64
+	err := e.rbac.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE id=?%s", e.entityHolder.getTable(), e.rbac.notDeleted("")), id).Scan(&result)
+	if err != nil {
+		return false, queryError("exists", err)
+	}
+
+	return result > 0, nil
+}
+
+// isAncestor reports whether the range of ancestorID strictly contains the one of descendantID.
+func (e entity) isAncestor(ancestorID, descendantID int64) (bool, error) {
+	query := fmt.Sprintf(`
+		SELECT COUNT(*)
+		FROM %s AS ancestor,
+			%s AS descendant
+		WHERE ancestor.id=? AND descendant.id=?
+		AND ancestor.%s < descendant.%s AND ancestor.%s > descendant.%s`, e.entityHolder.getTable(), e.entityHolder.getTable(), Left, Left, Right, Right)
+
+	var result int64
+	err := e.rbac.db.QueryRow(query, ancestorID, descendantID).Scan(&result)
+	if err != nil {
+		return false, queryError("isAncestor", err)
+	}
+
+	return result > 0, nil
+}
+
+// subtreeSize returns the number of descendants of a node from its lft and rght alone.
+// Soft-deleted descendants are counted as well, they still occupy the range.
+func (e entity) subtreeSize(id int64) (int64, error) {
+	var result int64
+	query := fmt.Sprintf("SELECT (%s - %s - 1) DIV 2 FROM %s WHERE id=?%s", Right, Left, e.entityHolder.getTable(), e.rbac.notDeleted(""))
+	err := e.rbac.db.QueryRow(query, id).Scan(&result)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrNodeNotFound
+		}
+		return 0, queryError("subtreeSize", err)
+	}
+
+	return result, nil
+}
+
+// raw returns the stored id, lft and rght of a node, soft-deleted nodes included.
+func (e entity) raw(id int64) (int64, int64, int64, error) {
+	var left, right int64
+	query := fmt.Sprintf("SELECT id, %s, %s FROM %s WHERE id=?", Left, Right, e.entityHolder.getTable())
+	err := e.rbac.db.QueryRow(query, id).Scan(&id, &left, &right)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, 0, 0, ErrNodeNotFound
+		}
+		return 0, 0, 0, queryError("raw", err)
+	}
+
+	return id, left, right, nil
+}
+
+// depthHistogram counts the descendants of a node per depth relative to the node.
+func (e entity) depthHistogram(id int64) (map[int64]int64, error) {
+	table := e.entityHolder.getTable()
+	query := fmt.Sprintf(`
+		SELECT Depth, COUNT(*)
+		FROM (
+			SELECT node.ID, COUNT(parent.ID)-1 AS Depth
+			FROM %s AS sub_tree
+			JOIN %s AS node ON (node.%s > sub_tree.%s AND node.%s < sub_tree.%s)
+			JOIN %s AS parent ON (node.%s BETWEEN parent.%s AND parent.%s AND parent.%s >= sub_tree.%s)
+			WHERE sub_tree.ID=?%s
+			GROUP BY node.ID
+		) AS depths
+		GROUP BY Depth
+		ORDER BY Depth`, table, table, Left, Left, Left, Right, table, Left, Left, Right, Left, Left, e.rbac.notDeleted("node"))
+
+	rows, err := e.rbac.reader().Query(query, id)
+	if err != nil {
+		return nil, queryError("depthHistogram", err)
+	}
+	defer rows.Close()
+
+	result := make(map[int64]int64)
+	for rows.Next() {
+		var depth, count int64
+		err := rows.Scan(&depth, &count)
+		if err != nil {
+			return nil, queryError("depthHistogram", err)
+		}
+		result[depth] = count
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, queryError("depthHistogram", err)
+	}
+
+	if len(result) == 0 {
+		exists, err := e.exists(id)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, ErrNodeNotFound
+		}
+	}
+
+	return result, nil
+}
+
 func (e entity) returnID(entity string) (int64, error) {
 	var entityID int64
 	var err error
-	if entity[:1] == "/" {
+	if isPath(entity) {
 		entityID, err = e.pathID(entity)
 	} else {
 		entityID, err = e.titleID(entity)
@@ -452,12 +1187,148 @@ func (e entity) returnID(entity string) (int64, error) {
 }
 
 func (e entity) descendants(absolute bool, id int64) ([]path, error) {
-	var depthConcat string
-	if !absolute {
-		depthConcat = "- (sub_tree.innerDepth )"
+	var result []path
+	err := e.descendantsFunc(absolute, id, func(p path) error {
+		result = append(result, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// descendantsFunc streams the descendants of a node to fn, it stops as soon as fn returns an error.
+func (e entity) descendantsFunc(absolute bool, id int64, fn func(path) error) error {
+	return e.walkDescendants(absolute, id, descendantsFilter{}, fn)
+}
+
+// descendantsToDepth returns the descendants of a node at most maxDepth levels below it.
+func (e entity) descendantsToDepth(id int64, maxDepth int64) ([]path, error) {
+	if maxDepth < 1 {
+		return nil, nil
+	}
+
+	var result []path
+	err := e.walkDescendants(false, id, descendantsFilter{maxDepth: maxDepth}, func(p path) error {
+		result = append(result, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// descendantsFiltered returns the descendants of a node whose title and description match the LIKE patterns.
+func (e entity) descendantsFiltered(id int64, titleLike, descriptionLike string) ([]path, error) {
+	var result []path
+	err := e.walkDescendants(false, id, descendantsFilter{titleLike: titleLike, descriptionLike: descriptionLike}, func(p path) error {
+		result = append(result, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// leaves returns the descendants of a node that have no children themselves.
+func (e entity) leaves(id int64) ([]path, error) {
+	var result []path
+	err := e.walkDescendants(false, id, descendantsFilter{leavesOnly: true}, func(p path) error {
+		result = append(result, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// paths returns the path of every node below the root, in tree order.
+func (e entity) paths() ([]string, error) {
+	query := fmt.Sprintf("SELECT id, %s, %s, %s FROM %s WHERE id<>?%s ORDER BY %s, id",
+		Title, Left, Right, e.entityHolder.getTable(), e.rbac.notDeleted(""), Left)
+	rows, err := e.rbac.db.Query(query, e.rbac.rootID())
+	if err != nil {
+		return nil, queryError("paths", err)
+	}
+	defer rows.Close()
+
+	type ancestor struct {
+		right int64
+		path  string
+	}
+
+	var result []string
+	var stack []ancestor
+	for rows.Next() {
+		var id, left, right int64
+		var title string
+		err := rows.Scan(&id, &title, &left, &right)
+		if err != nil {
+			return nil, queryError("paths", err)
+		}
+
+		for len(stack) > 0 && stack[len(stack)-1].right < left {
+			stack = stack[:len(stack)-1]
+		}
+
+		var parent string
+		if len(stack) > 0 {
+			parent = stack[len(stack)-1].path
+		}
+
+		path := parent + "/" + escapeTitle(title)
+		result = append(result, path)
+		stack = append(stack, ancestor{right, path})
+	}
+
+	return result, queryError("paths", rows.Err())
+}
+
+// descendantsFilter narrows down the descendants returned by walkDescendants.
+// A maxDepth of 0 means no limit, empty patterns match everything.
+type descendantsFilter struct {
+	maxDepth        int64
+	titleLike       string
+	descriptionLike string
+	leavesOnly      bool
+}
+
+// walkDescendants streams the descendants of a node matching filter to fn.
+// The node itself is never included. Depth is relative to the node unless absolute
+// is set, filter.maxDepth is always relative.
+// Nodes are streamed in tree order, i.e. by lft: every node comes right before its own
+// descendants and siblings keep their insertion order. Ties are broken by ID.
+func (e entity) walkDescendants(absolute bool, id int64, filter descendantsFilter, fn func(path) error) error {
+	where := e.rbac.notDeleted("node")
+	args := []interface{}{id}
+	if filter.titleLike != "" {
+		where += " AND node." + Title + " LIKE ?"
+		args = append(args, filter.titleLike)
+	}
+	if filter.descriptionLike != "" {
+		where += " AND node." + Description + " LIKE ?"
+		args = append(args, filter.descriptionLike)
+	}
+	if filter.leavesOnly {
+		where += fmt.Sprintf(" AND node.%s = node.%s + 1", Right, Left)
+	}
+
+	having := "RelativeDepth > 0"
+	if filter.maxDepth > 0 {
+		having += " AND RelativeDepth <= ?"
+		args = append(args, filter.maxDepth)
 	}
+
 	query := fmt.Sprintf(`
-            SELECT node.ID, node.Title, node.Description, (COUNT(parent.ID)-1 %s) AS Depth
+            SELECT node.ID, node.%s, node.%s, (COUNT(parent.ID)-1 - (sub_tree.innerDepth )) AS RelativeDepth, COUNT(parent.ID)-1 AS AbsoluteDepth
             FROM %s AS node,
             	%s AS parent,
             	%s AS sub_parent,
@@ -472,34 +1343,48 @@ func (e entity) descendants(absolute bool, id int64) ([]path, error) {
             	) AS sub_tree
             WHERE node.%s BETWEEN parent.%s AND parent.%s
             	AND node.%s BETWEEN sub_parent.%s AND sub_parent.%s
-            	AND sub_parent.ID = sub_tree.ID
+            	AND sub_parent.ID = sub_tree.ID%s
             GROUP BY node.ID
-            HAVING Depth > 0
-            ORDER BY node.%s
-	`, depthConcat, e.entityHolder.getTable(), e.entityHolder.getTable(), e.entityHolder.getTable(), e.entityHolder.getTable(), e.entityHolder.getTable(), Left, Left, Right, Left, Left, Left, Right, Left, Left, Right, Left)
+            HAVING %s
+            ORDER BY node.%s, node.ID
+	`, Title, Description, e.entityHolder.getTable(), e.entityHolder.getTable(), e.entityHolder.getTable(), e.entityHolder.getTable(), e.entityHolder.getTable(), Left, Left, Right, Left, Left, Left, Right, Left, Left, Right, where, having, Left)
 
-	var result []path
-	rows, err := e.rbac.db.Query(query, id)
+	rows, err := e.rbac.reader().Query(query, args...)
 	if err != nil {
-		return nil, err
+		return queryError("descendants", err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var p path
-		err := rows.Scan(&p.ID, &p.Title, &p.Description, &p.Depth)
+		var description sql.NullString
+		err := rows.Scan(&p.ID, &p.Title, &description, &p.Depth, &p.AbsoluteDepth)
 		if err != nil {
-			return nil, err
+			return queryError("descendants", err)
+		}
+		p.Description = description.String
+		if absolute {
+			p.Depth = p.AbsoluteDepth
+		}
+
+		err = fn(p)
+		if err != nil {
+			return err
 		}
-		result = append(result, p)
 	}
 
-	return result, nil
+	err = rows.Err()
+	if err != nil {
+		return queryError("descendants", err)
+	}
+
+	return nil
 }
 
+// children returns the direct children of id in the same order as walkDescendants.
 func (e entity) children(id int64) ([]path, error) {
 	query := fmt.Sprintf(`
-            SELECT node.ID, node.Title, node.Description,(COUNT(parent.ID)-1 - (sub_tree.innerDepth )) AS Depth
+            SELECT node.ID, node.%s, node.%s,(COUNT(parent.ID)-1 - (sub_tree.innerDepth )) AS Depth, COUNT(parent.ID)-1 AS AbsoluteDepth
             FROM %s AS node,
             	%s AS parent,
             	%s AS sub_parent,
@@ -514,28 +1399,35 @@ func (e entity) children(id int64) ([]path, error) {
             	) AS sub_tree
             WHERE node.%s BETWEEN parent.%s AND parent.%s
             	AND node.%s BETWEEN sub_parent.%s AND sub_parent.%s
-            	AND sub_parent.ID = sub_tree.ID
+            	AND sub_parent.ID = sub_tree.ID%s
             GROUP BY node.ID
-            HAVING Depth > 0
-            ORDER BY node.%s
-	`, e.entityHolder.getTable(), e.entityHolder.getTable(), e.entityHolder.getTable(), e.entityHolder.getTable(), e.entityHolder.getTable(), Left, Left, Right, Left, Left, Left, Right, Left, Left, Right, Left)
+            HAVING Depth = 1
+            ORDER BY node.%s, node.ID
+	`, Title, Description, e.entityHolder.getTable(), e.entityHolder.getTable(), e.entityHolder.getTable(), e.entityHolder.getTable(), e.entityHolder.getTable(), Left, Left, Right, Left, Left, Left, Right, Left, Left, Right, e.rbac.notDeleted("node"), Left)
 
 	var result []path
-	rows, err := e.rbac.db.Query(query, id)
+	rows, err := e.rbac.reader().Query(query, id)
 	if err != nil {
-		return nil, err
+		return nil, queryError("children", err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var p path
-		err := rows.Scan(&p.ID, &p.Title, &p.Description, &p.Depth)
+		var description sql.NullString
+		err := rows.Scan(&p.ID, &p.Title, &description, &p.Depth, &p.AbsoluteDepth)
 		if err != nil {
-			return nil, err
+			return nil, queryError("children", err)
 		}
+		p.Description = description.String
 		result = append(result, p)
 	}
 
+	err = rows.Err()
+	if err != nil {
+		return nil, queryError("children", err)
+	}
+
 	return result, nil
 
 }
@@ -0,0 +1,42 @@
+// Package middleware provides net/http helpers for enforcing gorbac permissions.
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/jgrusewski/gorbac"
+)
+
+// RequirePermission returns a middleware that only lets a request through when
+// the user returned by userIDFromRequest has the given permission.
+// The check is bound to the request context, so it gives up once the request is done.
+// It responds with 403 when the user cannot be identified or lacks the permission,
+// and with 500 when the check itself errors.
+func RequirePermission(rbac *gorbac.Rbac, perm string, userIDFromRequest func(*http.Request) (int64, error)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID, err := userIDFromRequest(r)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+
+			ok, err := rbac.CheckContext(r.Context(), perm, userID)
+			if err == gorbac.ErrUserRequired {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+
+			if !ok {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package gorbac
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// column is an optional column added to an existing schema by Migrate.
+type column struct {
+	table      string
+	name       string
+	definition string
+}
+
+// migrations lists the columns added since the original schema in schema/gorack.sql.
+// The user_roles columns are added to the configured users table.
+var migrations = []column{
+	{"user_roles", "valid_until", "datetime DEFAULT NULL"},
+	{"permissions", "resource", "varchar(64) CHARACTER SET utf8 DEFAULT NULL"},
+	{"permissions", "action", "varchar(64) CHARACTER SET utf8 DEFAULT NULL"},
+	{"roles", "deleted_at", "datetime DEFAULT NULL"},
+	{"permissions", "deleted_at", "datetime DEFAULT NULL"},
+	{"role_permissions", "type", "enum('allow','deny') NOT NULL DEFAULT 'allow'"},
+}
+
+// resize is a column whose type Migrate changes unless it is one of the accepted types.
+type resize struct {
+	table      string
+	name       string
+	definition string
+	accept     []string
+}
+
+// resizes lets roles and permissions hold titles of up to 255 characters and
+// descriptions of up to 65535 bytes, longer TEXT types are kept.
+var resizes = []resize{
+	{"roles", Title, "varchar(255) CHARACTER SET utf8 NOT NULL", []string{"varchar(255)"}},
+	{"permissions", Title, "varchar(255) CHARACTER SET utf8 NOT NULL", []string{"varchar(255)"}},
+	{"roles", Description, "text CHARACTER SET utf8 NOT NULL", []string{"text", "mediumtext", "longtext"}},
+	{"permissions", Description, "text CHARACTER SET utf8 NOT NULL", []string{"text", "mediumtext", "longtext"}},
+}
+
+// tables lists the tables added since the original schema, they are created when missing.
+var tables = []string{
+	`CREATE TABLE IF NOT EXISTS audit_log (
+		id int(11) NOT NULL AUTO_INCREMENT,
+		operation varchar(32) NOT NULL,
+		entity varchar(64) NOT NULL,
+		entity_id int(11) NOT NULL,
+		target text DEFAULT NULL,
+		actor varchar(128) NOT NULL DEFAULT '',
+		created_at datetime NOT NULL,
+		PRIMARY KEY (id)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin`,
+}
+
+// schema records which optional columns exist, so the core queries keep working on a
+// database that hasn't run Migrate yet.
+type schema struct {
+	// denies is set when role_permissions has the type column, without it every assignment is an allow.
+	denies bool
+	// expiry is set when the users table has the valid_until column, without it assignments don't expire.
+	expiry bool
+}
+
+// ErrMigrationRequired is returned by operations that need a column added by Migrate.
+var ErrMigrationRequired = errors.New("the database schema is outdated, run Migrate")
+
+// detectSchema looks up the optional columns, it runs once on connect and after Migrate.
+func (r Rbac) detectSchema() error {
+	denies, err := r.hasColumn("role_permissions", "type")
+	if err != nil {
+		return err
+	}
+
+	expiry, err := r.hasColumn(r.usersTable, "valid_until")
+	if err != nil {
+		return err
+	}
+
+	*r.schema = schema{denies: denies, expiry: expiry}
+
+	return nil
+}
+
+// hasColumn reports whether table has the column name in the current database.
+func (r Rbac) hasColumn(table, name string) (bool, error) {
+	var count int64
+	err := r.db.QueryRow(`
+		SELECT COUNT(*) FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA=DATABASE() AND TABLE_NAME=? AND COLUMN_NAME=?`, table, name).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// Migrate adds the tables and columns required by optional features to an existing schema.
+// Tables and columns that already exist are left alone, so it is safe to run on every start.
+// Titles are widened to 255 characters and descriptions to TEXT, which holds up to 65535 bytes.
+// Until it has run, deny assignments return ErrMigrationRequired and every assignment is an allow,
+// and user-role assignments don't expire.
+// Run it before serving requests, the detected columns are shared by all copies of the Rbac.
+func (r Rbac) Migrate() error {
+	_, err := r.db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		user_id int(11) NOT NULL,
+		role_id int(11) NOT NULL,
+		assignment_date int(11) NOT NULL,
+		valid_until datetime DEFAULT NULL,
+		PRIMARY KEY (user_id, role_id)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin`, r.usersTable))
+	if err != nil {
+		return err
+	}
+
+	for _, t := range tables {
+		_, err := r.db.Exec(t)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, c := range migrations {
+		table := c.table
+		if table == "user_roles" {
+			table = r.usersTable
+		}
+
+		exists, err := r.hasColumn(table, c.name)
+		if err != nil {
+			return err
+		}
+
+		if exists {
+			continue
+		}
+
+		_, err = r.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN `%s` %s", table, c.name, c.definition))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, c := range resizes {
+		var columnType string
+		err := r.db.QueryRow(`
+			SELECT COLUMN_TYPE FROM information_schema.COLUMNS
+			WHERE TABLE_SCHEMA=DATABASE() AND TABLE_NAME=? AND COLUMN_NAME=?`, c.table, c.name).Scan(&columnType)
+		if err != nil {
+			return err
+		}
+
+		if accepted(columnType, c.accept) {
+			continue
+		}
+
+		_, err = r.db.Exec(fmt.Sprintf("ALTER TABLE %s MODIFY COLUMN `%s` %s", c.table, c.name, c.definition))
+		if err != nil {
+			return err
+		}
+	}
+
+	return r.detectSchema()
+}
+
+func accepted(columnType string, types []string) bool {
+	for _, t := range types {
+		if strings.EqualFold(columnType, t) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,5 +1,11 @@
 package gorbac
 
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
 type Permissions struct {
 	rbac   *Rbac
 	entity entityInternal
@@ -31,7 +37,8 @@ func (p Permissions) Unassign(role RoleInterface, permission PermissionInterface
 	return p.entity.unassign(role, permission)
 }
 
-func (p Permissions) Add(title string, description string, parentID int64) (int64, error) {
+func (p Permissions) Add(title string, description string, parentID int64) (_ int64, err error) {
+	defer p.rbac.observe("Permissions.Add", time.Now(), &err)
 	return p.entity.add(title, description, parentID)
 }
 
@@ -51,32 +58,133 @@ func (p Permissions) Reset(ensure bool) error {
 	return p.entity.reset(ensure)
 }
 
-func (p Permissions) AddPath(path string, description []string) (int64, error) {
+// AddPath creates the missing Permissions of a path like "/billing/read".
+// Returns the number of Permissions created as int64, the same as Roles().AddPath.
+func (p Permissions) AddPath(path string, description []string) (_ int64, err error) {
+	defer p.rbac.observe("Permissions.AddPath", time.Now(), &err)
 	return p.entity.addPath(path, description)
 }
 
+// AddPaths creates the missing Permissions of all paths in a single transaction.
+// Returns the total number of Permissions created, nothing is created when an error is returned.
+// Prefixes shared by several paths are only looked up once.
+func (p Permissions) AddPaths(paths []PathSpec) (int64, error) {
+	var created int64
+	err := p.rbac.Tx(func(tx *Rbac) error {
+		var err error
+		created, err = tx.PermissionsIn(p.table).entity.addPaths(paths)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return created, nil
+}
+
+// AddAction creates the Permission "/resource/action" and stores resource and action in their own columns.
+// Returns the ID of the action Permission. The columns are created by Migrate.
+// The Permission is created and tagged in a single transaction.
+func (p Permissions) AddAction(resource, action, description string) (permissionID int64, err error) {
+	defer p.rbac.observe("Permissions.AddAction", time.Now(), &err)
+
+	path := "/" + escapeTitle(resource) + "/" + escapeTitle(action)
+	err = p.rbac.Tx(func(tx *Rbac) error {
+		permissions := tx.PermissionsIn(p.table)
+
+		_, err := permissions.entity.addPath(path, []string{"", description})
+		if err != nil {
+			return err
+		}
+
+		permissionID, err = permissions.entity.pathID(path)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.db.Exec(fmt.Sprintf("UPDATE %s SET resource=?, action=? WHERE id=?", p.getTable()), resource, action, permissionID)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return permissionID, nil
+}
+
+// ActionID returns the ID of the Permission created by AddAction for resource and action.
+func (p Permissions) ActionID(resource, action string) (int64, error) {
+	var permissionID int64
+	err := p.rbac.db.QueryRow(fmt.Sprintf("SELECT id FROM %s WHERE resource=? AND action=?%s", p.getTable(), p.rbac.notDeleted("")), resource, action).Scan(&permissionID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrPermissionNotFound
+		}
+		return 0, err
+	}
+
+	return permissionID, nil
+}
+
+// GetPermissionID resolves a Permission given as ID, title or path to its ID.
 func (p Permissions) GetPermissionID(permission PermissionInterface) (int64, error) {
 	var permissionID int64
 	var err error
 	if _, ok := permission.(int64); ok {
 		permissionID = permission.(int64)
 	} else if _, ok := permission.(string); ok {
-		if permission.(string)[:1] == "/ " {
-			permissionID, err = p.entity.pathID(permission.(string))
-			if err != nil {
-				return 0, err
-			}
-		} else {
-			permissionID, err = p.entity.titleID(permission.(string))
-			if err != nil {
-				return 0, err
-			}
+		permissionID, err = p.entity.returnID(permission.(string))
+		if err != nil {
+			return 0, err
 		}
 	}
 
 	return permissionID, nil
 }
 
+// Exists checks whether a Permission exists, a Permission that can't be found is not an error.
+func (p Permissions) Exists(permission PermissionInterface) (bool, error) {
+	permissionID, err := p.GetPermissionID(permission)
+	if err == ErrTitleNotFound || err == ErrPathNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return p.entity.exists(permissionID)
+}
+
+// ExistsByPath checks whether a Permission exists at path, with Config.CachePaths without a query on repeated checks.
+func (p Permissions) ExistsByPath(path string) (bool, error) {
+	_, err := p.entity.pathID(path)
+	if err == ErrPathNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// RoleCount returns the number of Roles the Permission is directly assigned to.
+func (p Permissions) RoleCount(permission PermissionInterface) (int, error) {
+	permissionID, err := p.GetPermissionID(permission)
+	if err != nil {
+		return 0, err
+	}
+
+	var result int
+	err = p.rbac.db.QueryRow("SELECT COUNT(*) FROM role_permissions WHERE permission_id=?", permissionID).Scan(&result)
+	if err != nil {
+		return 0, err
+	}
+
+	return result, nil
+}
+
+// Count returns the number of Permissions, the synthetic root is not counted.
 func (p Permissions) Count() (int64, error) {
 	return p.entity.count()
 }
@@ -89,6 +197,16 @@ func (p Permissions) GetTitle(id int64) (string, error) {
 	return p.entity.getTitle(id)
 }
 
+// Get returns the title, description, depth and path of a Permission in a single query.
+func (p Permissions) Get(id int64) (*NodeInfo, error) {
+	return p.entity.get(id)
+}
+
+// GetMany returns the ID, title and description of several Permissions in a single query, unknown IDs are missing.
+func (p Permissions) GetMany(ids []int64) (map[int64]path, error) {
+	return p.entity.getMany(ids)
+}
+
 func (p Permissions) GetPath(id int64) (string, error) {
 	return p.entity.getPath(id)
 }
@@ -97,22 +215,114 @@ func (p Permissions) Depth(id int64) (int64, error) {
 	return p.entity.depth(id)
 }
 
-func (p Permissions) Edit(id int64, title, description string) error {
+func (p Permissions) Edit(id int64, title, description string) (err error) {
+	defer p.rbac.observe("Permissions.Edit", time.Now(), &err)
 	return p.entity.edit(id, title, description)
 }
 
+// EditByRef changes the title and description of a Permission given as ID, title or path.
+func (p Permissions) EditByRef(permission PermissionInterface, title, description string) (err error) {
+	defer p.rbac.observe("Permissions.EditByRef", time.Now(), &err)
+
+	permissionID, err := p.GetPermissionID(permission)
+	if err != nil {
+		return err
+	}
+
+	return p.entity.edit(permissionID, title, description)
+}
+
+// Rename changes the title of a Permission and leaves its description untouched.
+func (p Permissions) Rename(id int64, title string) (err error) {
+	defer p.rbac.observe("Permissions.Rename", time.Now(), &err)
+	return p.entity.rename(id, title)
+}
+
+// SetDescription changes the description of a Permission and leaves its title untouched.
+func (p Permissions) SetDescription(id int64, description string) (err error) {
+	defer p.rbac.observe("Permissions.SetDescription", time.Now(), &err)
+	return p.entity.setDescription(id, description)
+}
+
 func (p Permissions) ParentNode(id int64) (int64, error) {
 	return p.entity.parentNode(id)
 }
 
+// Parent returns the ID, title and depth of the parent of a Permission, or nil for the root.
+func (p Permissions) Parent(id int64) (*path, error) {
+	return p.entity.parent(id)
+}
+
+// Ancestors returns the chain from the root to the parent of a Permission, ordered by lft.
+func (p Permissions) Ancestors(id int64) ([]path, error) {
+	return p.entity.ancestors(id)
+}
+
+// Search returns at most limit Permissions whose title starts with prefix, ordered by title.
+func (p Permissions) Search(prefix string, limit int) ([]path, error) {
+	return p.entity.search(prefix, limit)
+}
+
 func (p Permissions) ReturnID(entity string) (int64, error) {
-	return p.entity.pathID(entity)
+	return p.entity.returnID(entity)
 }
 
+// Descendants returns the descendants of a Permission in tree order, like Roles.Descendants.
 func (p Permissions) Descendants(absolute bool, id int64) ([]path, error) {
 	return p.entity.descendants(absolute, id)
 }
 
+// DescendantsFunc calls fn for every descendant of a Permission until fn returns an error, which is then returned.
+func (p Permissions) DescendantsFunc(absolute bool, id int64, fn func(path) error) error {
+	return p.entity.descendantsFunc(absolute, id, fn)
+}
+
+// DescendantsToDepth returns descendants of a Permission at most maxDepth levels deep, with their relative depths.
+func (p Permissions) DescendantsToDepth(id int64, maxDepth int64) ([]path, error) {
+	return p.entity.descendantsToDepth(id, maxDepth)
+}
+
+// DescendantsFiltered returns descendants of a Permission whose title and description match the LIKE patterns.
+func (p Permissions) DescendantsFiltered(id int64, titleLike, descriptionLike string) ([]path, error) {
+	return p.entity.descendantsFiltered(id, titleLike, descriptionLike)
+}
+
+// ResolveMany returns the IDs of many Permissions referenced by title or path, unknown ones are missing.
+func (p Permissions) ResolveMany(refs []string) (map[string]int64, error) {
+	return p.entity.resolveMany(refs)
+}
+
+// SubtreeSize returns the number of descendants of a Permission with a single row lookup.
+func (p Permissions) SubtreeSize(id int64) (int64, error) {
+	return p.entity.subtreeSize(id)
+}
+
+// Raw returns the nested set values of a Permission as stored, soft-deleted Permissions included.
+func (p Permissions) Raw(id int64) (_, lft, rght int64, err error) {
+	return p.entity.raw(id)
+}
+
+// DepthHistogram counts the descendants of a Permission per depth, the children of underID are at depth 1.
+func (p Permissions) DepthHistogram(underID int64) (map[int64]int64, error) {
+	return p.entity.depthHistogram(underID)
+}
+
+// IsAncestor checks whether ancestorID is above descendantID in the tree.
+func (p Permissions) IsAncestor(ancestorID, descendantID int64) (bool, error) {
+	return p.entity.isAncestor(ancestorID, descendantID)
+}
+
+// IsDescendant checks whether descendantID is below ancestorID in the tree.
+func (p Permissions) IsDescendant(descendantID, ancestorID int64) (bool, error) {
+	return p.entity.isAncestor(ancestorID, descendantID)
+}
+
+// Leaves returns the Permissions below underID that have no children, e.g. to offer them in an assignment UI.
+func (p Permissions) Leaves(underID int64) ([]path, error) {
+	return p.entity.leaves(underID)
+}
+
+// Children returns the direct children of a Permission, deeper descendants are left out.
 func (p Permissions) Children(id int64) ([]path, error) {
 	return p.entity.children(id)
 }
@@ -1,14 +1,20 @@
 package gorbac
 
 import (
+	"context"
 	"database/sql"
+	"encoding/csv"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	// Import go-sql-driver package
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 )
 
 // Config MySQL connection string
@@ -18,26 +24,255 @@ type Config struct {
 	Port     int
 	Username string
 	Password string
+
+	// UsersTable is the table holding the user-role assignments, it defaults to "user_roles".
+	// Migrate creates it when it doesn't exist.
+	UsersTable string
+
+	// Params are added to the DSN, e.g. {"tls": "true", "charset": "utf8mb4"}.
+	Params map[string]string
+
+	// MaxPathBytes is the session group_concat_max_len, the maximum length of a path built
+	// from the titles of its nodes. It defaults to 1MB, MySQL and MariaDB truncate at 1024 bytes.
+	MaxPathBytes int
+
+	// ReplicaDSN is the data source name of a read replica, e.g. "user:pass@tcp(replica:3306)/rbac".
+	// When set, Check, HasRole and the listing of descendants, children and roles read from it,
+	// everything else uses the primary. The params of the primary are added unless set in it.
+	ReplicaDSN string
+
+	// QueryTimeout bounds every query, it defaults to 5 seconds and a negative value disables it.
+	// Each query gets its own deadline, CheckContext only applies it when its context has none.
+	// ExportAssignmentsCSV streams without a deadline.
+	QueryTimeout time.Duration
+
+	// MaxRetries is the number of times Tx retries a transaction that hit a deadlock
+	// or lock wait timeout, with exponential backoff starting at 10ms.
+	MaxRetries int
+
+	// CaseInsensitiveTitles makes titles and paths resolve regardless of case.
+	CaseInsensitiveTitles bool
+
+	// CachePaths caches resolved paths in this instance, the cache is dropped on
+	// every change made through it. Only enable it when no other process edits the tree.
+	CachePaths bool
+
+	// RootTitle is the title of the synthetic root node, it defaults to "root".
+	RootTitle string
+
+	// SoftDelete makes Remove set deleted_at instead of deleting the node, removed
+	// nodes are hidden from all reads but stay in the table. It requires Migrate.
+	SoftDelete bool
+
+	// Audit records every mutation in the audit_log table, see AuditLog. It requires Migrate.
+	Audit bool
+
+	// ActorID is recorded as the author of mutations in the audit log, use WithActor to override it per call.
+	ActorID string
+
+	// SeedRootAssignments makes Reset and ResetAssignments assign the root Role to the root
+	// Permission and to user 1, which grants that user everything. They are left empty by default.
+	SeedRootAssignments bool
+
+	// DryRun makes destructive operations report what they would remove instead of removing it.
+	// Remove and RemoveSubtree return a DryRunError, use DryRunIDs to get the affected node IDs.
+	DryRun bool
+
+	// Observer is notified about the duration and outcome of operations.
+	Observer Observer
+}
+
+// Observer receives the duration and error of each operation, e.g. to feed metrics.
+type Observer interface {
+	ObserveOp(name string, dur time.Duration, err error)
 }
 
 type Rbac struct {
 	permissions *Permissions
 	roles       *Roles
-	users       Owners // Default
+	users       Users // Default
 
 	extensions map[string]Owners
 
-	db *sql.DB
+	pool      *sql.DB
+	replica   *sql.DB
+	db        dbtx
+	tx        *sql.Tx
+	stmts     *stmtCache
+	observer  Observer
+	dryRun    bool
+	soft      bool
+	auditing  bool
+	actor     string
+	timeout   time.Duration
+	rootTitle string
+	dialect   Dialect
+	schema    *schema
+
+	replicaStmts    *stmtCache
+	caseInsensitive bool
+	paths           *pathCache
+	maxRetries      int
+	usersTable      string
+	seedRoot        bool
 }
 
 var (
+	ErrRoleNotFound       = errors.New("role not found")
 	ErrPermissionNotFound = errors.New("permission not found")
+	ErrAlreadyAssigned    = errors.New("already assigned")
+	ErrNotAssigned        = errors.New("not assigned")
+)
+
+// AssignmentType is the polarity of a Role-Permission relation.
+type AssignmentType string
+
+// A deny takes precedence over any allow of the same Permission, see Check.
+const (
+	AssignmentAllow AssignmentType = "allow"
+	AssignmentDeny  AssignmentType = "deny"
+)
+
+// Assignment is a Role-Permission relation with both sides resolved.
+type Assignment struct {
+	RoleID          int64
+	RoleTitle       string
+	PermissionID    int64
+	PermissionTitle string
+	Type            AssignmentType
+}
+
+// Error messages for an invalid Config.
+var (
+	ErrHostRequired     = errors.New("host is required")
+	ErrNameRequired     = errors.New("database name is required")
+	ErrUsernameRequired = errors.New("username is required")
+	ErrInvalidPort      = errors.New("port must be between 1 and 65535")
 )
 
+// defaultPort is the MySQL port used when Config.Port is zero.
+const defaultPort = 3306
+
+// defaultMaxPathBytes is the session group_concat_max_len used when Config.MaxPathBytes is zero.
+const defaultMaxPathBytes = 1 << 20
+
 // New returns a new instance of Rbac
+// It is fatal when the config is invalid or the database can't be reached, use NewE to handle the error.
 func New(config *Config) *Rbac {
+	rbac, err := NewE(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return rbac
+}
+
+// NewE returns a new instance of Rbac after validating the config and connecting to the database.
+// A zero Config.Port connects to the default MySQL port 3306.
+// Columns missing until Migrate has run are detected here, the features needing them are disabled.
+func NewE(config *Config) (*Rbac, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	if config.Port == 0 {
+		config.Port = defaultPort
+	}
+
+	var rbac = newRbac(config)
+
+	var err error
+	rbac.pool, err = sql.Open("mysql", config.dsn())
+	if err != nil {
+		return nil, err
+	}
+	rbac.db = rbac.timed(rbac.pool)
+
+	err = rbac.pool.Ping()
+	if err != nil {
+		rbac.pool.Close()
+		return nil, fmt.Errorf("connecting to %s:%d: %w", config.Host, config.Port, err)
+	}
+
+	err = rbac.detectSchema()
+	if err != nil {
+		rbac.pool.Close()
+		return nil, err
+	}
+
+	if config.ReplicaDSN != "" {
+		var dsn string
+		dsn, err = config.replicaDSN()
+		if err == nil {
+			rbac.replica, err = sql.Open("mysql", dsn)
+		}
+		if err == nil {
+			err = rbac.replica.Ping()
+		}
+		if err != nil {
+			rbac.pool.Close()
+			return nil, fmt.Errorf("connecting to replica: %w", err)
+		}
+		rbac.replicaStmts = newStmtCache()
+	}
+
+	return rbac, nil
+}
+
+// NewFromDSN returns a new instance of Rbac connected to dsn, e.g. "root:pass@tcp(localhost:3306)/smartident".
+// It is fatal when the database can't be reached, use NewFromDSNE to handle the error.
+func NewFromDSN(driver, dsn string) *Rbac {
+	rbac, err := NewFromDSNE(driver, dsn)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return rbac
+}
+
+// NewFromDSNE returns a new instance of Rbac connected to dsn with the default settings.
+// Only the mysql driver is supported, others return ErrUnsupportedDriver.
+// Add group_concat_max_len=1048576 to MySQL DSNs when paths can be longer than 1024 bytes.
+// The DSN is used as is, add parseTime=true when reading the audit log or assignment expiry.
+func NewFromDSNE(driver, dsn string) (*Rbac, error) {
+	dialect, err := dialectFor(driver)
+	if err != nil {
+		return nil, err
+	}
+
+	var rbac = newRbac(&Config{})
+	rbac.dialect = dialect
+
+	rbac.pool, err = sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	rbac.db = rbac.timed(rbac.pool)
+
+	err = rbac.pool.Ping()
+	if err != nil {
+		rbac.pool.Close()
+		return nil, fmt.Errorf("connecting: %w", err)
+	}
+
+	err = rbac.detectSchema()
+	if err != nil {
+		rbac.pool.Close()
+		return nil, err
+	}
+
+	return rbac, nil
+}
+
+// newRbac returns an Rbac set up from config, without a connection.
+func newRbac(config *Config) *Rbac {
 	var rbac = new(Rbac)
 
+	rbac.usersTable = config.UsersTable
+	if rbac.usersTable == "" {
+		rbac.usersTable = "user_roles"
+	}
+
 	rbac.roles = newRoleManager(rbac)
 	rbac.permissions = newPermissions(rbac)
 	rbac.users = newUsers(rbac)
@@ -45,19 +280,120 @@ func New(config *Config) *Rbac {
 	rbac.extensions = make(map[string]Owners, 1)
 	rbac.AddOwnerExtension("users", newUsers(rbac))
 
-	if config.Port == 0 {
-		config.Port = 3306
+	if config.QueryTimeout == 0 {
+		config.QueryTimeout = 5 * time.Second
 	}
+	rbac.timeout = config.QueryTimeout
+	rbac.maxRetries = config.MaxRetries
 
-	var err error
-	rbac.db, err = sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?parseTime=true", config.Username, config.Password, config.Host, config.Port, config.Name))
-	if err != nil {
-		log.Fatal(err)
+	rbac.stmts = newStmtCache()
+	rbac.schema = &schema{}
+	rbac.dialect = MySQL
+	rbac.observer = config.Observer
+	rbac.dryRun = config.DryRun
+	rbac.soft = config.SoftDelete
+	rbac.seedRoot = config.SeedRootAssignments
+	rbac.auditing = config.Audit
+	rbac.actor = config.ActorID
+	rbac.caseInsensitive = config.CaseInsensitiveTitles
+	if config.CachePaths {
+		rbac.paths = newPathCache()
+	}
+
+	rbac.rootTitle = config.RootTitle
+	if rbac.rootTitle == "" {
+		rbac.rootTitle = "root"
 	}
 
 	return rbac
 }
 
+func (c Config) validate() error {
+	if c.Host == "" {
+		return ErrHostRequired
+	}
+
+	if c.Name == "" {
+		return ErrNameRequired
+	}
+
+	if c.Username == "" {
+		return ErrUsernameRequired
+	}
+
+	if c.Port < 0 || c.Port > 65535 {
+		return ErrInvalidPort
+	}
+
+	return nil
+}
+
+// dsn builds the MySQL data source name, parseTime is applied unless overridden in Params.
+// group_concat_max_len is set to MaxPathBytes for every connection, the default of 1024 bytes
+// on MySQL and MariaDB truncates the paths of deep trees that are built with GROUP_CONCAT.
+func (c Config) dsn() string {
+	params := c.params()
+
+	port := c.Port
+	if port == 0 {
+		port = defaultPort
+	}
+
+	return fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?%s", c.Username, c.Password, c.Host, port, c.Name, params.Encode())
+}
+
+// params returns the DSN params of the primary, see dsn.
+func (c Config) params() url.Values {
+	maxPathBytes := c.MaxPathBytes
+	if maxPathBytes <= 0 {
+		maxPathBytes = defaultMaxPathBytes
+	}
+
+	params := url.Values{}
+	params.Set("parseTime", "true")
+	params.Set("group_concat_max_len", strconv.Itoa(maxPathBytes))
+	for key, value := range c.Params {
+		params.Set(key, value)
+	}
+
+	return params
+}
+
+// replicaDSN returns the ReplicaDSN with the params of the primary added, params set in it are kept.
+func (c Config) replicaDSN() (string, error) {
+	_, err := mysql.ParseDSN(c.ReplicaDSN)
+	if err != nil {
+		return "", err
+	}
+
+	// ParseDSN has checked the slash before the database name, the params follow the name.
+	dsn := c.ReplicaDSN
+	name := dsn[strings.LastIndex(dsn, "/"):]
+
+	separator := "?"
+	existing := url.Values{}
+	if i := strings.Index(name, "?"); i >= 0 {
+		separator = "&"
+		existing, err = url.ParseQuery(name[i+1:])
+		if err != nil {
+			return "", err
+		}
+	}
+
+	missing := url.Values{}
+	for key, values := range c.params() {
+		if _, ok := existing[key]; !ok {
+			missing[key] = values
+		}
+	}
+
+	if len(missing) == 0 {
+		return dsn, nil
+	}
+
+	return dsn + separator + missing.Encode(), nil
+}
+
 func (r *Rbac) AddOwnerExtension(name string, extension Owners) error {
 	if r.extensions[name] != nil {
 		return fmt.Errorf("extestion with: (%v) already loaded", name)
@@ -73,39 +409,141 @@ func (r *Rbac) OwnerExtension(name string) Owners {
 }
 
 func (r *Rbac) DB() *sql.DB {
-	return r.db
+	return r.pool
+}
+
+// Close releases the cached prepared statements and the database pools.
+func (r *Rbac) Close() error {
+	stmtErr := r.stmts.close()
+
+	if r.replica != nil {
+		r.replicaStmts.close()
+		r.replica.Close()
+	}
+
+	err := r.pool.Close()
+	if err != nil {
+		return err
+	}
+
+	return stmtErr
 }
 
 // Assign a role to a permission.
 // Returns true if successful, false if unsuccessful.
+// Assign doesn't touch the tree, so it is safe next to concurrent tree mutations.
+// Use Tx to make tree changes and assignments atomically.
+// ErrRoleNotFound or ErrPermissionNotFound is returned when either doesn't exist.
 func (r Rbac) Assign(role RoleInterface, permission PermissionInterface) (int64, error) {
-	var err error
-	var roleID int64
-	var permissionID int64
+	return r.AssignType(role, permission, AssignmentAllow)
+}
 
-	roleID, err = r.Roles().GetRoleID(role)
-	if err != nil {
-		return 0, err
+// AssignByID assigns a role to a permission, both given by ID.
+func (r Rbac) AssignByID(roleID, permissionID int64) (int64, error) {
+	return r.Assign(roleID, permissionID)
+}
+
+// AssignByTitle assigns a role to a permission, both given by title or path.
+func (r Rbac) AssignByTitle(role, permission string) (int64, error) {
+	return r.Assign(role, permission)
+}
+
+// AssignType assigns a role to a permission with the given polarity,
+// AssignmentDeny explicitly denies the permission to users of the role.
+// Denies return ErrMigrationRequired until Migrate has added the type column.
+func (r Rbac) AssignType(role RoleInterface, permission PermissionInterface, typ AssignmentType) (_ int64, err error) {
+	defer r.observe("Assign", time.Now(), &err)
+
+	if typ == AssignmentDeny && !r.schema.denies {
+		return 0, ErrMigrationRequired
 	}
 
-	permissionID, err = r.permissions.GetPermissionID(permission)
+	roleID, permissionID, err := r.assignmentIDs(role, permission)
 	if err != nil {
 		return 0, err
 	}
 
-	res, err := r.db.Exec("INSERT INTO role_permissions (role_id, permission_id, assignment_date) VALUES(?,?,?)", roleID, permissionID, time.Now().Nanosecond())
+	query, args := r.assignmentInsert(roleID, permissionID, typ)
+	res, err := r.db.Exec(query, args...)
 	if err != nil {
+		if r.assigned(roleID, permissionID) {
+			return 0, ErrAlreadyAssigned
+		}
 		return 0, err
 	}
 
 	insertID, _ := res.LastInsertId()
 
+	operation := "assign"
+	if typ == AssignmentDeny {
+		operation = "deny"
+	}
+
+	err = r.audit(operation, "role_permissions", roleID, permissionID)
+	if err != nil {
+		return 0, err
+	}
+
 	return insertID, nil
 }
 
+// AssignIfAbsent assigns a role to a permission unless they are already assigned.
+// Returns true if a new assignment has been created, as an allow.
+// The lookup and the insert run in a single transaction.
+func (r Rbac) AssignIfAbsent(role RoleInterface, permission PermissionInterface) (created bool, err error) {
+	defer r.observe("AssignIfAbsent", time.Now(), &err)
+
+	roleID, permissionID, err := r.assignmentIDs(role, permission)
+	if err != nil {
+		return false, err
+	}
+
+	err = r.Tx(func(tx *Rbac) error {
+		created = false
+
+		var count int64
+		err := tx.db.QueryRow("SELECT COUNT(*) FROM role_permissions WHERE role_id=? AND permission_id=? FOR UPDATE", roleID, permissionID).Scan(&count)
+		if err != nil || count > 0 {
+			return err
+		}
+
+		query, args := tx.assignmentInsert(roleID, permissionID, AssignmentAllow)
+		_, err = tx.db.Exec(query, args...)
+		if err != nil {
+			return err
+		}
+		created = true
+
+		return tx.audit("assign", "role_permissions", roleID, permissionID)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return created, nil
+}
+
+// assignmentInsert returns the INSERT of a Role-Permission relation, the type is
+// left out while the schema has no type column.
+func (r Rbac) assignmentInsert(roleID, permissionID int64, typ AssignmentType) (string, []interface{}) {
+	if !r.schema.denies {
+		return "INSERT INTO role_permissions (role_id, permission_id, assignment_date) VALUES(?,?,?)", []interface{}{roleID, permissionID, assignmentDate()}
+	}
+
+	return "INSERT INTO role_permissions (role_id, permission_id, assignment_date, type) VALUES(?,?,?,?)", []interface{}{roleID, permissionID, assignmentDate(), typ}
+}
+
+// EnsureAssignment makes sure a role is assigned to a permission, for reconciling
+// assignments against a declarative configuration. It reports whether the assignment
+// had to be created, an existing assignment is left as it is, including its type.
+func (r Rbac) EnsureAssignment(role RoleInterface, permission PermissionInterface) (created bool, err error) {
+	return r.AssignIfAbsent(role, permission)
+}
+
 // Unassign a Role-Permission relation.
-func (r Rbac) Unassign(role RoleInterface, permission PermissionInterface) error {
-	var err error
+func (r Rbac) Unassign(role RoleInterface, permission PermissionInterface) (err error) {
+	defer r.observe("Unassign", time.Now(), &err)
+
 	var roleID int64
 	var permissionID int64
 
@@ -119,18 +557,214 @@ func (r Rbac) Unassign(role RoleInterface, permission PermissionInterface) error
 		return err
 	}
 
-	_, err = r.db.Exec("DELETE FROM role_permissions WHERE role_id=? AND permission_id=?", roleID, permissionID)
+	res, err := r.db.Exec("DELETE FROM role_permissions WHERE role_id=? AND permission_id=?", roleID, permissionID)
 
 	if err != nil {
 		return err
 	}
 
-	return nil
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return ErrNotAssigned
+	}
+
+	return r.audit("unassign", "role_permissions", roleID, permissionID)
+}
+
+// Assignments returns the Role-Permission relations with their titles, ordered by role and permission in tree order.
+func (r Rbac) Assignments(limit, offset int) ([]Assignment, error) {
+	query := fmt.Sprintf(`
+		SELECT TR.ID, TR.%s, TP.ID, TP.%s, %s
+		FROM role_permissions AS TRel
+		JOIN roles AS TR ON (TR.ID=TRel.role_id)
+		JOIN permissions AS TP ON (TP.ID=TRel.permission_id)
+		ORDER BY TR.%s, TP.%s
+		LIMIT ? OFFSET ?`, Title, Title, r.assignmentType("TRel"), Left, Left)
+
+	rows, err := r.reader().Query(query, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []Assignment
+	for rows.Next() {
+		var a Assignment
+		err := rows.Scan(&a.RoleID, &a.RoleTitle, &a.PermissionID, &a.PermissionTitle, &a.Type)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, a)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// ExportAssignmentsCSV writes the Role-Permission relations to w as CSV rows of
+// roleTitle, permissionTitle and assignedAt, after a header row and in the order of Assignments.
+// The rows are streamed from the database, assignedAt is the assignment time in RFC 3339 and UTC.
+// It is empty for assignments made by older versions, which only stored the nanoseconds of the second.
+func (r Rbac) ExportAssignmentsCSV(w io.Writer) (err error) {
+	defer r.observe("ExportAssignmentsCSV", time.Now(), &err)
+
+	query := fmt.Sprintf(`
+		SELECT TR.%s, TP.%s, TRel.assignment_date
+		FROM role_permissions AS TRel
+		JOIN roles AS TR ON (TR.ID=TRel.role_id)
+		JOIN permissions AS TP ON (TP.ID=TRel.permission_id)
+		ORDER BY TR.%s, TP.%s`, Title, Title, Left, Left)
+
+	rows, err := r.reader().QueryContext(context.Background(), query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	out := csv.NewWriter(w)
+	err = out.Write([]string{"roleTitle", "permissionTitle", "assignedAt"})
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		var role, permission string
+		var assignedAt int64
+		err := rows.Scan(&role, &permission, &assignedAt)
+		if err != nil {
+			return err
+		}
+
+		var formatted string
+		if assignedAt >= minAssignmentDate {
+			formatted = time.Unix(assignedAt, 0).UTC().Format(time.RFC3339)
+		}
+
+		err = out.Write([]string{role, permission, formatted})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	out.Flush()
+	return out.Error()
+}
+
+// minAssignmentDate is the lowest assignment_date holding a Unix time, older versions
+// stored the nanoseconds of the second, which are always below it.
+const minAssignmentDate = 1e9
+
+// assignmentDate returns the value stored in assignment_date, the Unix time in seconds.
+func assignmentDate() int64 {
+	return time.Now().Unix()
+}
+
+// orphaned joins role_permissions to the nodes it references, keeping the rows
+// of which the Role or the Permission no longer exists.
+const orphaned = `
+	FROM role_permissions AS TRel
+	LEFT JOIN roles AS TR ON (TR.ID=TRel.role_id)
+	LEFT JOIN permissions AS TP ON (TP.ID=TRel.permission_id)
+	WHERE TR.ID IS NULL OR TP.ID IS NULL`
+
+// FindOrphanedAssignments returns the Role-Permission relations referencing a Role or
+// Permission that doesn't exist anymore, e.g. after deleting rows by hand.
+// The title of the missing side is empty.
+func (r Rbac) FindOrphanedAssignments() ([]Assignment, error) {
+	query := fmt.Sprintf(`
+		SELECT TRel.role_id, COALESCE(TR.%s, ''), TRel.permission_id, COALESCE(TP.%s, ''), %s%s
+		ORDER BY TRel.role_id, TRel.permission_id`, Title, Title, r.assignmentType("TRel"), orphaned)
+
+	rows, err := r.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []Assignment
+	for rows.Next() {
+		var a Assignment
+		err := rows.Scan(&a.RoleID, &a.RoleTitle, &a.PermissionID, &a.PermissionTitle, &a.Type)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, a)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// PurgeOrphanedAssignments removes the relations returned by FindOrphanedAssignments
+// and returns the number of removed relations.
+func (r Rbac) PurgeOrphanedAssignments() (_ int64, err error) {
+	defer r.observe("PurgeOrphanedAssignments", time.Now(), &err)
+
+	res, err := r.db.Exec("DELETE TRel" + orphaned)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// assigned reports whether a Role-Permission relation exists, it is used to
+// translate driver specific duplicate key errors.
+func (r Rbac) assigned(roleID, permissionID int64) bool {
+	var result int64
+	err := r.db.QueryRow("SELECT COUNT(*) FROM role_permissions WHERE role_id=? AND permission_id=?", roleID, permissionID).Scan(&result)
+
+	return err == nil && result > 0
 }
 
 // Check whether a user has a permission or not.
 // Returns true if a user has a permission, false if otherwise.
+// Permissions are hierarchical, a role assigned "/billing" grants "/billing/invoices/read" as well.
+// A deny assigned to any of the roles of the user takes precedence over the grants, denies are hierarchical too.
+// Unknown permissions return ErrPermissionNotFound.
 func (r Rbac) Check(permission PermissionInterface, userID UserInterface) (bool, error) {
+	return r.CheckContext(context.Background(), permission, userID)
+}
+
+// CheckPath checks whether a user has the permission at path, e.g. "/billing/invoices/read".
+func (r Rbac) CheckPath(path string, userID UserInterface) (bool, error) {
+	if !isPath(path) {
+		return false, ErrPathNotFound
+	}
+
+	return r.Check(path, userID)
+}
+
+// CheckAction checks whether a user has the Permission created by AddAction for resource and action.
+func (r Rbac) CheckAction(resource, action string, userID UserInterface) (bool, error) {
+	permissionID, err := r.permissions.ActionID(resource, action)
+	if err != nil {
+		return false, err
+	}
+
+	return r.Check(permissionID, userID)
+}
+
+// CheckContext is like Check but aborts the query when ctx is done.
+// When ctx expires the error of ctx is returned instead of a deny.
+func (r Rbac) CheckContext(ctx context.Context, permission PermissionInterface, userID UserInterface) (_ bool, err error) {
+	defer r.observe("Check", time.Now(), &err)
+
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
 	if _, ok := userID.(string); ok {
 		if userID.(string) == "" {
 			return false, ErrUserRequired
@@ -141,52 +775,152 @@ func (r Rbac) Check(permission PermissionInterface, userID UserInterface) (bool,
 		}
 	}
 
-	permissionID, err := r.permissions.GetPermissionID(permission)
+	permissionID, err := r.permissionID(permission)
 	if err != nil {
 		return false, err
 	}
 
-	if permissionID == 0 {
-		return false, ErrPermissionNotFound
-	}
-
 	lastPart := `
 	ON ( TR.ID = TRel.role_id)
 	WHERE
 		TUrel.user_id=?
 	AND
 		TPdirect.ID=?
-	`
-	query := fmt.Sprintf(`SELECT COUNT(*) AS Result
+	` + r.notExpired("TUrel")
+	query := fmt.Sprintf(`SELECT COUNT(*) AS Result, COALESCE(%s, 0) AS Denied
 	FROM
-		user_roles AS TUrel
+		%s AS TUrel
 	JOIN roles AS TRdirect ON (TRdirect.ID=TUrel.role_id)
-	JOIN roles AS TR ON ( TR.Lft BETWEEN TRdirect.Lft AND TRdirect.Rght)
+	JOIN roles AS TR ON ( TR.%s BETWEEN TRdirect.%s AND TRdirect.%s)
 	JOIN
 		(permissions AS TPdirect
-			JOIN permissions AS TP ON (TPdirect.Lft BETWEEN TP.Lft AND TP.Rght)
+			JOIN permissions AS TP ON (TPdirect.%s BETWEEN TP.%s AND TP.%s)
 			JOIN role_permissions AS TRel ON (TP.ID=TRel.permission_id)
-		) %s`, lastPart)
+		) %s`, r.denied("TRel"), r.usersTable, Left, Left, Right, Left, Left, Right, lastPart)
 
-	var result int64
+	var result, denied int64
+
+	stmt, err := r.prepare(ctx, query)
+	if err != nil {
+		return false, err
+	}
 
-	err = r.db.QueryRow(query, userID, permissionID).Scan(&result)
+	err = stmt.QueryRowContext(ctx, userID, permissionID).Scan(&result, &denied)
 	if err != nil {
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
 		if err != sql.ErrNoRows {
 			return false, err
 		}
 	}
 
-	if result > 0 {
+	if result > 0 && denied == 0 {
 		return true, nil
 	}
 
 	return false, nil
 }
 
+// CheckWithRoles is like Check for a user whose roles were resolved once with Users().RoleIDs,
+// so authorizing many permissions doesn't read the user's assignments each time.
+func (r Rbac) CheckWithRoles(permission PermissionInterface, roleIDs []int64) (_ bool, err error) {
+	defer r.observe("CheckWithRoles", time.Now(), &err)
+
+	if len(roleIDs) == 0 {
+		return false, nil
+	}
+
+	permissionID, err := r.permissionID(permission)
+	if err != nil {
+		return false, err
+	}
+
+	placeholders, args := inClause(roleIDs)
+	query := fmt.Sprintf(`SELECT COUNT(*) AS Result, COALESCE(%s, 0) AS Denied
+	FROM
+		roles AS TRdirect
+	JOIN roles AS TR ON ( TR.%s BETWEEN TRdirect.%s AND TRdirect.%s)
+	JOIN
+		(permissions AS TPdirect
+			JOIN permissions AS TP ON (TPdirect.%s BETWEEN TP.%s AND TP.%s)
+			JOIN role_permissions AS TRel ON (TP.ID=TRel.permission_id)
+		)
+	ON ( TR.ID = TRel.role_id)
+	WHERE
+		TRdirect.ID IN (%s)
+	AND
+		TPdirect.ID=?`, r.denied("TRel"), Left, Left, Right, Left, Left, Right, placeholders)
+
+	var result, denied int64
+	err = r.reader().QueryRow(query, append(args, permissionID)...).Scan(&result, &denied)
+	if err != nil {
+		return false, err
+	}
+
+	return result > 0 && denied == 0, nil
+}
+
+// assignmentIDs resolves the role and permission of an assignment, missing nodes yield ErrRoleNotFound or ErrPermissionNotFound.
+func (r Rbac) assignmentIDs(role RoleInterface, permission PermissionInterface) (int64, int64, error) {
+	roleID, err := r.roles.GetRoleID(role)
+	if err == ErrTitleNotFound || err == ErrPathNotFound {
+		return 0, 0, ErrRoleNotFound
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	exists, err := r.roles.entity.exists(roleID)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !exists {
+		return 0, 0, ErrRoleNotFound
+	}
+
+	permissionID, err := r.permissionID(permission)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	exists, err = r.permissions.entity.exists(permissionID)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !exists {
+		return 0, 0, ErrPermissionNotFound
+	}
+
+	return roleID, permissionID, nil
+}
+
+// permissionID resolves the permission to check, unknown titles and paths and
+// the zero ID yield ErrPermissionNotFound instead of being checked against the root.
+func (r Rbac) permissionID(permission PermissionInterface) (int64, error) {
+	permissionID, err := r.permissions.GetPermissionID(permission)
+	if err == ErrTitleNotFound || err == ErrPathNotFound {
+		return 0, ErrPermissionNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if permissionID == 0 {
+		return 0, ErrPermissionNotFound
+	}
+
+	return permissionID, nil
+}
+
 // Reset all roles, permissions and assignments.
 // Ensure is a required boolean parameter. If true is not passed an fatal will be thrown.
 func (r Rbac) Reset(ensure bool) {
+	if r.dryRun {
+		log.Println("gorbac: dry run, would reset all roles, permissions and assignments")
+		return
+	}
+
 	if err := r.roles.ResetAssignments(ensure); err != nil {
 		log.Fatal(err)
 	}
@@ -203,6 +937,93 @@ func (r Rbac) Reset(ensure bool) {
 	}
 }
 
+// ResetExcept resets all roles, permissions and assignments like Reset, but recreates the
+// Roles at the protected paths, with their ancestors, afterwards. The recreated Roles keep
+// their titles and descriptions but get new IDs and no assignments.
+func (r Rbac) ResetExcept(paths []string) error {
+	if r.dryRun {
+		log.Println("gorbac: dry run, would reset all roles, permissions and assignments except", paths)
+		return nil
+	}
+
+	specs := make([]PathSpec, 0, len(paths))
+	for _, path := range paths {
+		if !isPath(path) {
+			return fmt.Errorf("invalid path %q", path)
+		}
+
+		spec := PathSpec{Path: path}
+
+		var prefix string
+		for _, part := range splitPath(path[1:]) {
+			prefix += "/" + escapeTitle(part)
+
+			var description string
+			id, err := r.roles.entity.pathID(prefix)
+			if err == nil {
+				description, err = r.roles.entity.getDescription(id)
+			}
+			if err != nil && err != ErrPathNotFound {
+				return err
+			}
+			spec.Descriptions = append(spec.Descriptions, description)
+		}
+
+		specs = append(specs, spec)
+	}
+
+	if err := r.roles.ResetAssignments(true); err != nil {
+		return err
+	}
+	if err := r.roles.Reset(true); err != nil {
+		return err
+	}
+	if err := r.permissions.Reset(true); err != nil {
+		return err
+	}
+	if err := r.users.ResetAssignments(true); err != nil {
+		return err
+	}
+
+	_, err := r.roles.AddPaths(specs)
+	return err
+}
+
+// EnsureRoot creates the root of the roles and permissions trees if it is missing,
+// unlike Reset it leaves existing data alone and is a no-op on a populated tree.
+func (r Rbac) EnsureRoot() error {
+	err := r.roles.entity.ensureRoot()
+	if err != nil {
+		return err
+	}
+
+	return r.permissions.entity.ensureRoot()
+}
+
+// RootID returns the ID of the root of the roles tree, e.g. to list the top-level Roles with Children.
+// Returns ErrNodeNotFound when the root is missing.
+func (r Rbac) RootID() (int64, error) {
+	return r.treeRootID(r.roles.entity)
+}
+
+// PermissionsRootID returns the ID of the root of the permissions tree.
+// Returns ErrNodeNotFound when the root is missing.
+func (r Rbac) PermissionsRootID() (int64, error) {
+	return r.treeRootID(r.permissions.entity)
+}
+
+func (r Rbac) treeRootID(e entityInternal) (int64, error) {
+	exists, err := e.exists(r.rootID())
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, ErrNodeNotFound
+	}
+
+	return r.rootID(), nil
+}
+
 // Permissions exposes underlaying permissions struct
 func (r Rbac) Permissions() *Permissions {
 	return r.permissions
@@ -213,11 +1034,124 @@ func (r Rbac) Roles() *Roles {
 	return r.roles
 }
 
+// RolesIn returns a Roles manager for the roles tree stored in table, e.g. a legacy copy.
+// Only the tree operations use table, assignments are still read from role_permissions and the users table.
+func (r *Rbac) RolesIn(table string) *Roles {
+	roles := newRoleManager(r)
+	roles.table = table
+
+	return roles
+}
+
+// PermissionsIn returns a Permissions manager for the permissions tree stored in table.
+func (r *Rbac) PermissionsIn(table string) *Permissions {
+	permissions := newPermissions(r)
+	permissions.table = table
+
+	return permissions
+}
+
 // Users exposes underlaying users struct
-func (r Rbac) Users() Owners {
+func (r Rbac) Users() Users {
 	return r.users
 }
 
+// withTimeout applies the QueryTimeout to ctx unless it already has a deadline.
+func (r Rbac) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || r.timeout <= 0 {
+		return ctx, func() {}
+	}
+
+	return context.WithTimeout(ctx, r.timeout)
+}
+
+// lockWait returns the seconds GET_LOCK may wait, it stays below the QueryTimeout so a
+// busy lock yields ErrLockTimeout before the deadline of the query is reached.
+func (r Rbac) lockWait() int64 {
+	if r.timeout <= 0 {
+		return 10
+	}
+
+	wait := int64((r.timeout - time.Second) / time.Second)
+	if wait < 0 {
+		return 0
+	}
+
+	return wait
+}
+
+func (r Rbac) observe(name string, start time.Time, err *error) {
+	if r.observer == nil {
+		return
+	}
+
+	r.observer.ObserveOp(name, time.Since(start), *err)
+}
+
+// equals returns the SQL condition comparing column to a placeholder, honouring CaseInsensitiveTitles.
+func (r Rbac) equals(column string) string {
+	if r.caseInsensitive {
+		return fmt.Sprintf("LOWER(%s) = LOWER(?)", column)
+	}
+
+	return column + " = ?"
+}
+
+// notDeleted returns the condition hiding soft-deleted nodes of the table alias, if any.
+func (r Rbac) notDeleted(alias string) string {
+	if !r.soft {
+		return ""
+	}
+
+	if alias != "" {
+		alias += "."
+	}
+
+	return " AND " + alias + "deleted_at IS NULL"
+}
+
+// denied returns the SQL counting the deny assignments of the role_permissions alias,
+// zero when the schema has no type column yet.
+func (r Rbac) denied(alias string) string {
+	if !r.schema.denies {
+		return "0"
+	}
+
+	return fmt.Sprintf("SUM(%s.type='deny')", alias)
+}
+
+// allowed returns the condition keeping only the allow assignments of the role_permissions alias.
+func (r Rbac) allowed(alias string) string {
+	if !r.schema.denies {
+		return ""
+	}
+
+	return fmt.Sprintf(" AND %s.type='allow'", alias)
+}
+
+// assignmentType returns the SQL selecting the type of the role_permissions alias.
+func (r Rbac) assignmentType(alias string) string {
+	if !r.schema.denies {
+		return "'allow'"
+	}
+
+	return alias + ".type"
+}
+
+// notExpired returns the condition hiding user-role assignments of the table alias past their valid_until,
+// if the schema has the column.
+func (r Rbac) notExpired(alias string) string {
+	if !r.schema.expiry {
+		return ""
+	}
+
+	if alias != "" {
+		alias += "."
+	}
+
+	return fmt.Sprintf(" AND (%svalid_until IS NULL OR %svalid_until > NOW())", alias, alias)
+}
+
 func (r Rbac) rootID() int64 {
 	return 1
 }
@@ -1,10 +1,18 @@
 package gorbac
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"os"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/go-sql-driver/mysql"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -13,9 +21,15 @@ var mu sync.Mutex
 
 func TestMain(m *testing.M) {
 	rbacTest = New(&Config{Name: "smartident", Username: "root", Password: "pass", Host: "localhost", Port: 3306})
+	if err := rbacTest.Migrate(); err != nil {
+		panic(err)
+	}
 	rbacTest.Reset(true)
 
-	os.Exit(m.Run())
+	code := m.Run()
+	rbacTest.Close()
+
+	os.Exit(code)
 
 }
 
@@ -85,7 +99,7 @@ func TestAllRoles(t *testing.T) {
 	result, err := rbacTest.Users().RoleCount(105)
 	assert.Nil(t, err)
 
-	assert.Equal(t, 1, result)
+	assert.Equal(t, int64(1), result)
 }
 
 func TestRolePermissions(t *testing.T) {
@@ -111,7 +125,7 @@ func TestRemoveRole(t *testing.T) {
 	_, err = rbacTest.Assign("forum_moderator", permissionID)
 	assert.Nil(t, err)
 
-	err = rbacTest.Roles().Remove("forum_moderator", false)
+	err = rbacTest.Roles().Remove("forum_moderator", false, false)
 	assert.Nil(t, err)
 }
 func TestGetPath(t *testing.T) {
@@ -143,7 +157,7 @@ func TestRemoveRoleRecursive(t *testing.T) {
 	assert.Nil(t, err)
 
 	err = rbacTest.Unassign("forum_moderator", "delete_posts")
-	assert.Nil(t, err)
+	assert.Equal(t, ErrNotAssigned, err)
 
 	err = rbacTest.Unassign("forum_moderator", "edit_posts")
 	assert.Nil(t, err)
@@ -155,8 +169,22 @@ func TestRemoveRoleRecursive(t *testing.T) {
 	_, err = rbacTest.Assign("forum_moderator", permissionID)
 	assert.Nil(t, err)
 
-	err = rbacTest.Roles().Remove("forum_moderator", true)
+	err = rbacTest.Roles().Remove("forum_moderator", true, false)
+	assert.Nil(t, err)
+}
+
+func TestRemoveRoleSubtree(t *testing.T) {
+	_, err := rbacTest.Roles().AddPath("/subtree/child/grandchild", nil)
+	assert.Nil(t, err)
+
+	err = rbacTest.Roles().Remove("/subtree", true, false)
 	assert.Nil(t, err)
+
+	_, err = rbacTest.Roles().GetRoleID("/subtree/child")
+	assert.Equal(t, ErrPathNotFound, err)
+
+	_, err = rbacTest.Roles().GetRoleID("/subtree/child/grandchild")
+	assert.Equal(t, ErrPathNotFound, err)
 }
 
 func TestDepth(t *testing.T) {
@@ -221,5 +249,2081 @@ func TestChildren(t *testing.T) {
 	assert.Nil(t, err)
 	res, err := rbacTest.Roles().Children(roleID)
 	assert.Nil(t, err)
+	assert.Equal(t, 1, len(res))
+	assert.Equal(t, "testpath", res[0].Title)
+}
+
+func TestVerifyTree(t *testing.T) {
+	treeErrors, err := rbacTest.VerifyTree("roles")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(treeErrors))
+}
+
+func TestRebuildTree(t *testing.T) {
+	roleID, err := rbacTest.Roles().GetRoleID("my1")
+	assert.Nil(t, err)
+
+	_, err = rbacTest.DB().Exec("UPDATE roles SET rght = rght + 10 WHERE id=?", roleID)
+	assert.Nil(t, err)
+
+	treeErrors, err := rbacTest.VerifyTree("roles")
+	assert.Nil(t, err)
+	assert.NotEqual(t, 0, len(treeErrors))
+
+	err = rbacTest.RebuildTree("roles")
+	assert.Nil(t, err)
+
+	treeErrors, err = rbacTest.VerifyTree("roles")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(treeErrors))
+
+	res, err := rbacTest.Roles().Descendants(false, roleID)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(res))
+}
+
+func TestRolesDetailed(t *testing.T) {
+	_, err := rbacTest.Roles().AddPath("/staff/forum_moderator", nil)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Users().Assign("/staff/forum_moderator", int64(107), nil)
+	assert.Nil(t, err)
+
+	roles, err := rbacTest.Users().RolesDetailed(int64(107))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(roles))
+	assert.Equal(t, "forum_moderator", roles[0].Title)
+	assert.Equal(t, "/staff/forum_moderator", roles[0].Path)
+}
+
+func TestRemoveSubtree(t *testing.T) {
+	_, err := rbacTest.Roles().AddPath("/tenant/123/admin", nil)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Users().Assign("/tenant/123/admin", int64(108), nil)
+	assert.Nil(t, err)
+
+	err = rbacTest.Roles().RemoveSubtree("/tenant/123", true)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Roles().GetRoleID("/tenant/123/admin")
+	assert.Equal(t, ErrPathNotFound, err)
+
+	result, err := rbacTest.Users().RoleCount(int64(108))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), result)
+
+	_, err = rbacTest.Roles().GetRoleID("/tenant")
+	assert.Nil(t, err)
+}
+
+func TestDescendantsFunc(t *testing.T) {
+	roleID, err := rbacTest.Roles().GetRoleID("my1")
+	assert.Nil(t, err)
+
+	var count int
+	err = rbacTest.Roles().DescendantsFunc(false, roleID, func(p path) error {
+		count++
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count)
+
+	stop := errors.New("stop")
+	count = 0
+	err = rbacTest.Roles().DescendantsFunc(false, roleID, func(p path) error {
+		count++
+		return stop
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestGet(t *testing.T) {
+	roleID, err := rbacTest.Roles().GetRoleID("/my1/testpath/test1")
+	assert.Nil(t, err)
+
+	info, err := rbacTest.Roles().Get(roleID)
+	assert.Nil(t, err)
+	assert.Equal(t, roleID, info.ID)
+	assert.Equal(t, "test1", info.Title)
+	assert.Equal(t, int64(3), info.Depth)
+	assert.Equal(t, "/my1/testpath/test1", info.Path)
+}
+
+func TestAncestors(t *testing.T) {
+	roleID, err := rbacTest.Roles().GetRoleID("/my1/testpath/test1")
+	assert.Nil(t, err)
+
+	res, err := rbacTest.Roles().Ancestors(roleID)
+	assert.Nil(t, err)
 	assert.Equal(t, 3, len(res))
+	assert.Equal(t, "root", res[0].Title)
+	assert.Equal(t, "my1", res[1].Title)
+	assert.Equal(t, "testpath", res[2].Title)
+}
+
+func TestSearch(t *testing.T) {
+	res, err := rbacTest.Roles().Search("for", 10)
+	assert.Nil(t, err)
+	assert.NotEqual(t, 0, len(res))
+
+	res, err = rbacTest.Roles().Search("for%", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(res))
+}
+
+func TestExists(t *testing.T) {
+	exists, err := rbacTest.Roles().Exists("nope")
+	assert.Nil(t, err)
+	assert.Equal(t, false, exists)
+
+	exists, err = rbacTest.Roles().Exists("my1")
+	assert.Nil(t, err)
+	assert.Equal(t, true, exists)
+
+	exists, err = rbacTest.Permissions().Exists("delete_posts")
+	assert.Nil(t, err)
+	assert.Equal(t, true, exists)
+}
+
+func TestCheckContextDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	time.Sleep(time.Millisecond)
+
+	_, err := rbacTest.CheckContext(ctx, "delete_posts", 105)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func BenchmarkCheck(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		rbacTest.Check("delete_posts", 105)
+	}
+}
+
+func TestUnassignAll(t *testing.T) {
+	_, err := rbacTest.Roles().Add("decommissioned", "", 0)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Assign("decommissioned", "delete_posts")
+	assert.Nil(t, err)
+
+	removed, err := rbacTest.Roles().UnassignAll("decommissioned")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), removed)
+
+	permissions, err := rbacTest.Roles().Permissions("decommissioned")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(permissions))
+}
+
+func TestPermissionCount(t *testing.T) {
+	_, err := rbacTest.Roles().Add("counted", "", 0)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Assign("counted", "delete_posts")
+	assert.Nil(t, err)
+
+	count, err := rbacTest.Roles().PermissionCount("counted")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	count, err = rbacTest.Permissions().RoleCount("delete_posts")
+	assert.Nil(t, err)
+	assert.NotEqual(t, 0, count)
+}
+
+func TestAssignMany(t *testing.T) {
+	_, err := rbacTest.Roles().Add("onboarding", "", 0)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Users().Assign("onboarding", int64(201), nil)
+	assert.Nil(t, err)
+
+	assigned, err := rbacTest.Users().AssignMany("onboarding", []int64{201, 202, 203}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), assigned)
+}
+
+func TestAssignConflicts(t *testing.T) {
+	_, err := rbacTest.Roles().Add("conflicting", "", 0)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Assign("conflicting", "delete_posts")
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Assign("conflicting", "delete_posts")
+	assert.True(t, errors.Is(err, ErrAlreadyAssigned))
+
+	err = rbacTest.Unassign("conflicting", "delete_posts")
+	assert.Nil(t, err)
+
+	err = rbacTest.Unassign("conflicting", "delete_posts")
+	assert.True(t, errors.Is(err, ErrNotAssigned))
+}
+
+func TestAssignIfAbsent(t *testing.T) {
+	_, err := rbacTest.Roles().Add("idempotent", "", 0)
+	assert.Nil(t, err)
+
+	created, err := rbacTest.AssignIfAbsent("idempotent", "delete_posts")
+	assert.Nil(t, err)
+	assert.Equal(t, true, created)
+
+	created, err = rbacTest.AssignIfAbsent("idempotent", "delete_posts")
+	assert.Nil(t, err)
+	assert.Equal(t, false, created)
+
+	count, err := rbacTest.Roles().PermissionCount("idempotent")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestDescendantsToDepth(t *testing.T) {
+	roleID, err := rbacTest.Roles().GetRoleID("my1")
+	assert.Nil(t, err)
+
+	res, err := rbacTest.Roles().DescendantsToDepth(roleID, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(res))
+	assert.Equal(t, "testpath", res[0].Title)
+
+	res, err = rbacTest.Roles().DescendantsToDepth(roleID, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(res))
+}
+
+func TestPathResolution(t *testing.T) {
+	pathID, err := rbacTest.Roles().GetRoleID("/my/path")
+	assert.Nil(t, err)
+
+	trailingID, err := rbacTest.Roles().GetRoleID("/my/path/")
+	assert.Nil(t, err)
+	assert.Equal(t, pathID, trailingID)
+
+	byPath, err := rbacTest.Roles().GetRoleID("/my")
+	assert.Nil(t, err)
+
+	byTitle, err := rbacTest.Roles().GetRoleID("my")
+	assert.Nil(t, err)
+	assert.Equal(t, byPath, byTitle)
+
+	rootID, err := rbacTest.Roles().GetRoleID("/")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), rootID)
+
+	_, err = rbacTest.Roles().GetRoleID("")
+	assert.Equal(t, ErrTitleNotFound, err)
+}
+
+func TestTitleWithSlash(t *testing.T) {
+	_, err := rbacTest.Roles().AddPath(`/files/read\/write`, nil)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Roles().AddPath("/files/read", nil)
+	assert.Nil(t, err)
+
+	roleID, err := rbacTest.Roles().GetRoleID(`/files/read\/write`)
+	assert.Nil(t, err)
+
+	title, err := rbacTest.Roles().GetTitle(roleID)
+	assert.Nil(t, err)
+	assert.Equal(t, "read/write", title)
+
+	path, err := rbacTest.Roles().GetPath(roleID)
+	assert.Nil(t, err)
+	assert.Equal(t, `/files/read\/write`, path)
+
+	readID, err := rbacTest.Roles().GetRoleID("/files/read")
+	assert.Nil(t, err)
+	assert.NotEqual(t, roleID, readID)
+}
+
+func TestRename(t *testing.T) {
+	roleID, err := rbacTest.Roles().Add("renamed", "Keeps its description", 0)
+	assert.Nil(t, err)
+
+	err = rbacTest.Roles().Rename(roleID, "renamed1")
+	assert.Nil(t, err)
+
+	info, err := rbacTest.Roles().Get(roleID)
+	assert.Nil(t, err)
+	assert.Equal(t, "renamed1", info.Title)
+	assert.Equal(t, "Keeps its description", info.Description)
+
+	err = rbacTest.Roles().SetDescription(roleID, "New description")
+	assert.Nil(t, err)
+
+	info, err = rbacTest.Roles().Get(roleID)
+	assert.Nil(t, err)
+	assert.Equal(t, "renamed1", info.Title)
+	assert.Equal(t, "New description", info.Description)
+}
+
+func TestParent(t *testing.T) {
+	roleID, err := rbacTest.Roles().GetRoleID("/my1/testpath")
+	assert.Nil(t, err)
+
+	parent, err := rbacTest.Roles().Parent(roleID)
+	assert.Nil(t, err)
+	assert.Equal(t, "my1", parent.Title)
+	assert.Equal(t, int64(1), parent.Depth)
+
+	parent, err = rbacTest.Roles().Parent(1)
+	assert.Nil(t, err)
+	assert.Nil(t, parent)
+}
+
+func TestEnsureRole(t *testing.T) {
+	var wg sync.WaitGroup
+	ids := make([]int64, 2)
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id, err := rbacTest.Roles().EnsureRole("/seeded/role", nil)
+			assert.Nil(t, err)
+			ids[i] = id
+		}(i)
+	}
+	wg.Wait()
+
+	assert.NotEqual(t, int64(0), ids[0])
+	assert.Equal(t, ids[0], ids[1])
+}
+
+func TestConfigParams(t *testing.T) {
+	config := Config{Name: "db", Username: "user", Password: "pass", Host: "localhost", Port: 3306, Params: map[string]string{"tls": "true", "charset": "utf8mb4"}}
+	assert.Equal(t, "user:pass@tcp(localhost:3306)/db?charset=utf8mb4&group_concat_max_len=1048576&parseTime=true&tls=true", config.dsn())
+}
+
+func TestNewEValidation(t *testing.T) {
+	_, err := NewE(&Config{Name: "db", Username: "user"})
+	assert.Equal(t, ErrHostRequired, err)
+
+	_, err = NewE(&Config{Host: "localhost", Username: "user"})
+	assert.Equal(t, ErrNameRequired, err)
+
+	_, err = NewE(&Config{Name: "db", Host: "localhost", Username: "user", Port: 70000})
+	assert.Equal(t, ErrInvalidPort, err)
+}
+
+func TestConfigMaxPathBytes(t *testing.T) {
+	config := Config{Name: "db", Username: "user", Password: "pass", Host: "localhost", MaxPathBytes: 4096}
+	assert.Equal(t, "user:pass@tcp(localhost:3306)/db?group_concat_max_len=4096&parseTime=true", config.dsn())
+}
+
+func TestConfigDefaultPort(t *testing.T) {
+	config := Config{Name: "db", Username: "user", Password: "pass", Host: "localhost"}
+	assert.Equal(t, "user:pass@tcp(localhost:3306)/db?group_concat_max_len=1048576&parseTime=true", config.dsn())
+
+	rbac, err := NewE(&Config{Name: "smartident", Username: "root", Password: "pass", Host: "localhost"})
+	if assert.Nil(t, err) {
+		rbac.Close()
+	}
+}
+
+func TestAddPathExistingPrefix(t *testing.T) {
+	created, err := rbacTest.Roles().AddPath("/prefix", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), created)
+
+	prefixID, err := rbacTest.Roles().GetRoleID("/prefix")
+	assert.Nil(t, err)
+
+	created, err = rbacTest.Roles().AddPath("/prefix/tail/end", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), created)
+
+	tailID, err := rbacTest.Roles().GetRoleID("/prefix/tail")
+	assert.Nil(t, err)
+
+	parentID, err := rbacTest.Roles().ParentNode(tailID)
+	assert.Nil(t, err)
+	assert.Equal(t, prefixID, parentID)
+
+	created, err = rbacTest.Roles().AddPath("/prefix/tail/end", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), created)
+}
+
+func TestPermissionTree(t *testing.T) {
+	_, err := rbacTest.Permissions().AddPath("/forum/posts/delete", nil)
+	assert.Nil(t, err)
+
+	forumID, err := rbacTest.Permissions().ReturnID("forum")
+	assert.Nil(t, err)
+
+	deleteID, err := rbacTest.Permissions().ReturnID("delete")
+	assert.Nil(t, err)
+
+	depth, err := rbacTest.Permissions().Depth(deleteID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), depth)
+
+	res, err := rbacTest.Permissions().Descendants(false, forumID)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(res))
+
+	res, err = rbacTest.Permissions().Children(forumID)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(res))
+
+	parentID, err := rbacTest.Permissions().ParentNode(res[0].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, forumID, parentID)
+}
+
+func TestGetPermissionID(t *testing.T) {
+	_, err := rbacTest.Permissions().AddPath("/blog/comments/moderate", nil)
+	assert.Nil(t, err)
+
+	byPath, err := rbacTest.Permissions().GetPermissionID("/blog/comments/moderate")
+	assert.Nil(t, err)
+
+	byTitle, err := rbacTest.Permissions().GetPermissionID("moderate")
+	assert.Nil(t, err)
+	assert.Equal(t, byTitle, byPath)
+
+	byID, err := rbacTest.Permissions().GetPermissionID(byPath)
+	assert.Nil(t, err)
+	assert.Equal(t, byPath, byID)
+
+	_, err = rbacTest.Permissions().GetPermissionID("/blog/missing")
+	assert.Equal(t, ErrPathNotFound, err)
+}
+
+func TestDescendantsFiltered(t *testing.T) {
+	_, err := rbacTest.Permissions().AddPath("/documents/reader/read_all", []string{"", "read documents", "read all documents"})
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Permissions().AddPath("/documents/writer", []string{"", "write documents"})
+	assert.Nil(t, err)
+
+	documentsID, err := rbacTest.Permissions().GetPermissionID("/documents")
+	assert.Nil(t, err)
+
+	res, err := rbacTest.Permissions().DescendantsFiltered(documentsID, "read%", "")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(res))
+	assert.Equal(t, int64(1), res[0].Depth)
+	assert.Equal(t, int64(2), res[1].Depth)
+
+	res, err = rbacTest.Permissions().DescendantsFiltered(documentsID, "", "%"+EscapeLike("write")+"%")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(res))
+}
+
+func TestTxAddAndAssign(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := rbacTest.Tx(func(tx *Rbac) error {
+				roleID, err := tx.Roles().Add(fmt.Sprintf("tx_role_%d", i), "", 0)
+				if err != nil {
+					return err
+				}
+
+				_, err = tx.Assign(roleID, "delete_posts")
+				return err
+			})
+			assert.Nil(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	treeErrors, err := rbacTest.VerifyTree("roles")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(treeErrors))
+
+	for i := 0; i < 5; i++ {
+		success, err := rbacTest.Roles().HasPermission(fmt.Sprintf("tx_role_%d", i), "delete_posts")
+		assert.Nil(t, err)
+		assert.Equal(t, true, success)
+	}
+}
+
+func TestRemoveReassignToParent(t *testing.T) {
+	_, err := rbacTest.Roles().AddPath("/department/team", nil)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Assign("/department/team", "delete_posts")
+	assert.Nil(t, err)
+
+	err = rbacTest.Roles().Remove("/department/team", false, true)
+	assert.Nil(t, err)
+
+	success, err := rbacTest.Roles().HasPermission("/department", "delete_posts")
+	assert.Nil(t, err)
+	assert.Equal(t, true, success)
+}
+
+func TestNodeNotFound(t *testing.T) {
+	_, err := rbacTest.Roles().GetTitle(99999)
+	assert.True(t, errors.Is(err, ErrNodeNotFound))
+
+	_, err = rbacTest.Roles().GetDescription(99999)
+	assert.True(t, errors.Is(err, ErrNodeNotFound))
+
+	_, err = rbacTest.Roles().GetPath(99999)
+	assert.True(t, errors.Is(err, ErrNodeNotFound))
+
+	_, err = rbacTest.Roles().ParentNode(99999)
+	assert.True(t, errors.Is(err, ErrNodeNotFound))
+
+	_, err = rbacTest.Roles().Depth(99999)
+	assert.True(t, errors.Is(err, ErrNodeNotFound))
+}
+
+func TestGetPathRoot(t *testing.T) {
+	path, err := rbacTest.Permissions().GetPath(1)
+	assert.Nil(t, err)
+	assert.Equal(t, "/", path)
+
+	path, err = rbacTest.Roles().GetPath(1)
+	assert.Nil(t, err)
+	assert.Equal(t, "/", path)
+
+	permissionID, err := rbacTest.Permissions().GetPermissionID("/forum/posts")
+	assert.Nil(t, err)
+
+	path, err = rbacTest.Permissions().GetPath(permissionID)
+	assert.Nil(t, err)
+	assert.Equal(t, "/forum/posts", path)
+}
+
+func TestCheckPath(t *testing.T) {
+	_, err := rbacTest.Permissions().AddPath("/billing/read", nil)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Roles().Add("accountant", "", 0)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Assign("accountant", "/billing/read")
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Users().Assign("accountant", int64(301), nil)
+	assert.Nil(t, err)
+
+	success, err := rbacTest.CheckPath("/billing/read", int64(301))
+	assert.Nil(t, err)
+	assert.Equal(t, true, success)
+
+	success, err = rbacTest.Check("/billing/read", int64(301))
+	assert.Nil(t, err)
+	assert.Equal(t, true, success)
+
+	success, err = rbacTest.CheckPath("/billing/read", int64(302))
+	assert.Nil(t, err)
+	assert.Equal(t, false, success)
+
+	_, err = rbacTest.CheckPath("/billing/write", int64(301))
+	assert.Equal(t, ErrPermissionNotFound, err)
+}
+
+func TestCheckHierarchical(t *testing.T) {
+	_, err := rbacTest.Permissions().AddPath("/billing/invoices/read", nil)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Roles().Add("billing_admin", "", 0)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Assign("billing_admin", "/billing")
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Users().Assign("billing_admin", int64(303), nil)
+	assert.Nil(t, err)
+
+	success, err := rbacTest.Check("/billing/invoices/read", int64(303))
+	assert.Nil(t, err)
+	assert.Equal(t, true, success)
+
+	success, err = rbacTest.Check("delete_posts", int64(303))
+	assert.Nil(t, err)
+	assert.Equal(t, false, success)
+}
+
+func TestEffectivePermissions(t *testing.T) {
+	_, err := rbacTest.Roles().AddPath("/editors/junior", nil)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Assign("/editors", "delete_posts")
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Assign("/editors/junior", "/billing/read")
+	assert.Nil(t, err)
+
+	res, err := rbacTest.Roles().EffectivePermissions("/editors/junior")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(res))
+
+	res, err = rbacTest.Roles().EffectivePermissions("/editors")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(res))
+}
+
+func TestCount(t *testing.T) {
+	before, err := rbacTest.Roles().Count()
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Roles().Add("counted_role", "", 0)
+	assert.Nil(t, err)
+
+	after, err := rbacTest.Roles().Count()
+	assert.Nil(t, err)
+	assert.Equal(t, before+1, after)
+}
+
+func TestAddPaths(t *testing.T) {
+	created, err := rbacTest.Permissions().AddPaths([]PathSpec{
+		{Path: "/seed/a/read"},
+		{Path: "/seed/a/write"},
+		{Path: "/seed/b", Descriptions: []string{"Seeded", "B"}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), created)
+
+	_, err = rbacTest.Permissions().GetPermissionID("/seed/a/write")
+	assert.Nil(t, err)
+}
+
+func TestGetMany(t *testing.T) {
+	my1, err := rbacTest.Roles().GetRoleID("my1")
+	assert.Nil(t, err)
+
+	testpath, err := rbacTest.Roles().GetRoleID("/my1/testpath")
+	assert.Nil(t, err)
+
+	res, err := rbacTest.Roles().GetMany([]int64{my1, testpath, 99999})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(res))
+	assert.Equal(t, "testpath", res[testpath].Title)
+}
+
+func TestCheckAction(t *testing.T) {
+	permissionID, err := rbacTest.Permissions().AddAction("post", "delete", "Delete posts")
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Roles().Add("post_admin", "", 0)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Assign("post_admin", permissionID)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Users().Assign("post_admin", int64(401), nil)
+	assert.Nil(t, err)
+
+	success, err := rbacTest.CheckAction("post", "delete", int64(401))
+	assert.Nil(t, err)
+	assert.Equal(t, true, success)
+
+	_, err = rbacTest.CheckAction("post", "publish", int64(401))
+	assert.Equal(t, ErrPermissionNotFound, err)
+}
+
+func TestCaseInsensitiveTitles(t *testing.T) {
+	rbac := New(&Config{Name: "smartident", Username: "root", Password: "pass", Host: "localhost", Port: 3306, CaseInsensitiveTitles: true})
+	defer rbac.Close()
+
+	roleID, err := rbac.Roles().Add("CaseTitle", "", 0)
+	assert.Nil(t, err)
+
+	found, err := rbac.Roles().GetRoleID("CASETITLE")
+	assert.Nil(t, err)
+	assert.Equal(t, roleID, found)
+
+	found, err = rbac.Roles().GetRoleID("/casetitle")
+	assert.Nil(t, err)
+	assert.Equal(t, roleID, found)
+
+	// Without CaseInsensitiveTitles the lookup depends on the title collation, this expects the utf8_bin collation of schema/gorack.sql.
+	_, err = rbacTest.Roles().GetRoleID("CASETITLE")
+	assert.Equal(t, ErrTitleNotFound, err)
+}
+
+func TestCachePaths(t *testing.T) {
+	rbac := New(&Config{Name: "smartident", Username: "root", Password: "pass", Host: "localhost", Port: 3306, CachePaths: true})
+	defer rbac.Close()
+
+	roleID, err := rbac.Roles().AddPath("/cached/role", nil)
+	assert.Nil(t, err)
+
+	found, err := rbac.Roles().GetRoleID("/cached/role")
+	assert.Nil(t, err)
+	assert.Equal(t, roleID, found)
+
+	exists, err := rbac.Roles().ExistsByPath("/cached/role")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+
+	err = rbac.Roles().Rename(roleID, "renamed")
+	assert.Nil(t, err)
+
+	exists, err = rbac.Roles().ExistsByPath("/cached/role")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	found, err = rbac.Roles().GetRoleID("/cached/renamed")
+	assert.Nil(t, err)
+	assert.Equal(t, roleID, found)
+
+	err = rbac.Roles().Remove(roleID, false, false)
+	assert.Nil(t, err)
+
+	exists, err = rbac.Roles().ExistsByPath("/cached/renamed")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+}
+
+func TestSoftDelete(t *testing.T) {
+	rbac := New(&Config{Name: "smartident", Username: "root", Password: "pass", Host: "localhost", Port: 3306, SoftDelete: true})
+	defer rbac.Close()
+
+	_, err := rbac.Roles().AddPath("/soft/deleted", nil)
+	assert.Nil(t, err)
+
+	roleID, err := rbac.Roles().GetRoleID("/soft/deleted")
+	assert.Nil(t, err)
+
+	parentID, err := rbac.Roles().GetRoleID("/soft")
+	assert.Nil(t, err)
+
+	err = rbac.Roles().Remove(roleID, false, false)
+	assert.Nil(t, err)
+
+	_, err = rbac.Roles().GetRoleID("/soft/deleted")
+	assert.Equal(t, ErrPathNotFound, err)
+
+	children, err := rbac.Roles().Children(parentID)
+	assert.Nil(t, err)
+	assert.Len(t, children, 0)
+
+	var deletedAt *time.Time
+	err = rbac.DB().QueryRow("SELECT deleted_at FROM roles WHERE id=?", roleID).Scan(&deletedAt)
+	assert.Nil(t, err)
+	assert.NotNil(t, deletedAt)
+}
+
+func TestAuditLog(t *testing.T) {
+	rbac := New(&Config{Name: "smartident", Username: "root", Password: "pass", Host: "localhost", Port: 3306, Audit: true, ActorID: "system"})
+	defer rbac.Close()
+
+	roleID, err := rbac.Roles().Add("audited_role", "", 0)
+	assert.Nil(t, err)
+
+	permissionID, err := rbac.Permissions().Add("audited_permission", "", 0)
+	assert.Nil(t, err)
+
+	_, err = rbac.WithActor("alice").Assign(roleID, permissionID)
+	assert.Nil(t, err)
+
+	entries, err := rbac.AuditLog(3, 0)
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 3) {
+		assert.Equal(t, "assign", entries[0].Operation)
+		assert.Equal(t, "role_permissions", entries[0].Entity)
+		assert.Equal(t, roleID, entries[0].EntityID)
+		assert.Equal(t, fmt.Sprint(permissionID), entries[0].Target)
+		assert.Equal(t, "alice", entries[0].Actor)
+
+		assert.Equal(t, "add", entries[1].Operation)
+		assert.Equal(t, "permissions", entries[1].Entity)
+		assert.Equal(t, "system", entries[1].Actor)
+	}
+}
+
+func TestUsersUnassignAll(t *testing.T) {
+	_, err := rbacTest.Roles().AddPath("/offboarding/first", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Roles().AddPath("/offboarding/second", nil)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Users().Assign("/offboarding/first", int64(105), nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Users().Assign("/offboarding/second", int64(105), nil)
+	assert.Nil(t, err)
+
+	err = rbacTest.Users().Unassign("/offboarding/second", int64(105))
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Users().Assign("/offboarding/second", int64(105), nil)
+	assert.Nil(t, err)
+
+	removed, err := rbacTest.Users().UnassignAll(int64(105))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), removed)
+
+	count, err := rbacTest.Users().RoleCount(int64(105))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestRolesMerge(t *testing.T) {
+	sourceID, err := rbacTest.Roles().Add("merge_source", "", 0)
+	assert.Nil(t, err)
+	targetID, err := rbacTest.Roles().Add("merge_target", "", 0)
+	assert.Nil(t, err)
+
+	shared, err := rbacTest.Permissions().Add("merge_shared", "", 0)
+	assert.Nil(t, err)
+	only, err := rbacTest.Permissions().Add("merge_only_source", "", 0)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Assign(sourceID, shared)
+	assert.Nil(t, err)
+	_, err = rbacTest.Assign(sourceID, only)
+	assert.Nil(t, err)
+	_, err = rbacTest.Assign(targetID, shared)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Users().Assign(sourceID, int64(501), nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Users().Assign(targetID, int64(502), nil)
+	assert.Nil(t, err)
+
+	err = rbacTest.Roles().Merge(sourceID, targetID, true)
+	assert.Nil(t, err)
+
+	count, err := rbacTest.Roles().PermissionCount(targetID)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+
+	for _, userID := range []int64{501, 502} {
+		has, err := rbacTest.Users().HasRole(targetID, userID)
+		assert.Nil(t, err)
+		assert.True(t, has)
+	}
+
+	exists, err := rbacTest.Roles().Exists(sourceID)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+}
+
+func TestHasRoleInSubtree(t *testing.T) {
+	_, err := rbacTest.Roles().AddPath("/staff/forum/mod", nil)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Users().Assign("/staff/forum/mod", int64(601), nil)
+	assert.Nil(t, err)
+
+	has, err := rbacTest.Users().HasRoleInSubtree("/staff", int64(601))
+	assert.Nil(t, err)
+	assert.True(t, has)
+
+	has, err = rbacTest.Users().HasRole("/staff", int64(601))
+	assert.Nil(t, err)
+	assert.False(t, has)
+
+	has, err = rbacTest.Users().HasRoleInSubtree("/staff", int64(602))
+	assert.Nil(t, err)
+	assert.False(t, has)
+}
+
+func TestQueryTimeout(t *testing.T) {
+	config := Config{Name: "db", Username: "user", Password: "pass", Host: "localhost", Port: 3306, QueryTimeout: 2 * time.Second}
+	assert.Equal(t, "user:pass@tcp(localhost:3306)/db?group_concat_max_len=1048576&parseTime=true", config.dsn())
+
+	rbac := New(&Config{Name: "smartident", Username: "root", Password: "pass", Host: "localhost", Port: 3306, QueryTimeout: time.Second})
+	defer rbac.Close()
+
+	start := time.Now()
+	_, err := rbac.db.Exec("SELECT SLEEP(3)")
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < 3*time.Second)
+}
+
+func TestLockWait(t *testing.T) {
+	assert.Equal(t, int64(4), Rbac{timeout: 5 * time.Second}.lockWait())
+	assert.Equal(t, int64(0), Rbac{timeout: 500 * time.Millisecond}.lockWait())
+	assert.Equal(t, int64(10), Rbac{timeout: -1}.lockWait())
+}
+
+func TestRetryable(t *testing.T) {
+	assert.True(t, retryable(fmt.Errorf("adding role: %w", &mysql.MySQLError{Number: 1213})))
+	assert.True(t, retryable(&mysql.MySQLError{Number: 1205}))
+	assert.False(t, retryable(&mysql.MySQLError{Number: 1062}))
+	assert.False(t, retryable(errors.New("deadlock")))
+}
+
+func BenchmarkConcurrentTx(b *testing.B) {
+	rbac := New(&Config{Name: "smartident", Username: "root", Password: "pass", Host: "localhost", Port: 3306, MaxRetries: 10})
+	defer rbac.Close()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			err := rbac.Tx(func(tx *Rbac) error {
+				_, err := tx.Roles().Add("concurrent", "", 0)
+				return err
+			})
+			if err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+func TestReplica(t *testing.T) {
+	// The replica points at a database without the rbac tables, so only queries routed to it fail.
+	rbac := New(&Config{Name: "smartident", Username: "root", Password: "pass", Host: "localhost", Port: 3306, ReplicaDSN: "root:pass@tcp(localhost:3306)/information_schema?parseTime=true"})
+	defer rbac.Close()
+
+	roleID, err := rbac.Roles().Add("replica_role", "", 0)
+	assert.Nil(t, err)
+	permissionID, err := rbac.Permissions().Add("replica_permission", "", 0)
+	assert.Nil(t, err)
+
+	_, err = rbac.Assign(roleID, permissionID)
+	assert.Nil(t, err)
+
+	_, err = rbac.Check(permissionID, int64(701))
+	assert.NotNil(t, err)
+
+	_, err = rbac.Users().HasRole(roleID, int64(701))
+	assert.NotNil(t, err)
+
+	_, err = rbac.Roles().Children(roleID)
+	assert.NotNil(t, err)
+}
+
+func TestUsersPermissions(t *testing.T) {
+	first, err := rbacTest.Roles().Add("effective_first", "", 0)
+	assert.Nil(t, err)
+	second, err := rbacTest.Roles().Add("effective_second", "", 0)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Permissions().AddPath("/effective/read", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Permissions().AddPath("/effective/write", nil)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Assign(first, "/effective")
+	assert.Nil(t, err)
+	_, err = rbacTest.Assign(second, "/effective/write")
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Users().Assign(first, int64(801), nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Users().Assign(second, int64(801), nil)
+	assert.Nil(t, err)
+
+	permissions, err := rbacTest.Users().Permissions(int64(801))
+	assert.Nil(t, err)
+
+	var titles []string
+	for _, p := range permissions {
+		titles = append(titles, p.Title)
+	}
+	assert.Equal(t, []string{"effective", "read", "write"}, titles)
+}
+
+func TestDeny(t *testing.T) {
+	editor, err := rbacTest.Roles().Add("deny_editor", "", 0)
+	assert.Nil(t, err)
+	restricted, err := rbacTest.Roles().Add("deny_restricted", "", 0)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Permissions().AddPath("/deny_posts/delete", nil)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Assign(editor, "/deny_posts")
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Users().Assign(editor, int64(901), nil)
+	assert.Nil(t, err)
+
+	allowed, err := rbacTest.Check("/deny_posts/delete", int64(901))
+	assert.Nil(t, err)
+	assert.True(t, allowed)
+
+	_, err = rbacTest.AssignType(restricted, "/deny_posts/delete", AssignmentDeny)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Users().Assign(restricted, int64(901), nil)
+	assert.Nil(t, err)
+
+	allowed, err = rbacTest.Check("/deny_posts/delete", int64(901))
+	assert.Nil(t, err)
+	assert.False(t, allowed)
+
+	allowed, err = rbacTest.Check("/deny_posts", int64(901))
+	assert.Nil(t, err)
+	assert.True(t, allowed)
+
+	permissions, err := rbacTest.Users().Permissions(int64(901))
+	assert.Nil(t, err)
+	assert.Len(t, permissions, 1)
+}
+
+func TestDescendantsAbsoluteDepth(t *testing.T) {
+	_, err := rbacTest.Roles().AddPath("/depth_a/depth_b/depth_c", nil)
+	assert.Nil(t, err)
+
+	id, err := rbacTest.Roles().GetRoleID("/depth_a")
+	assert.Nil(t, err)
+
+	relative, err := rbacTest.Roles().Descendants(false, id)
+	assert.Nil(t, err)
+	absolute, err := rbacTest.Roles().Descendants(true, id)
+	assert.Nil(t, err)
+
+	if assert.Len(t, relative, 2) && assert.Len(t, absolute, 2) {
+		assert.Equal(t, "depth_c", relative[1].Title)
+		assert.Equal(t, int64(2), relative[1].Depth)
+		assert.Equal(t, int64(3), relative[1].AbsoluteDepth)
+
+		assert.Equal(t, "depth_c", absolute[1].Title)
+		assert.Equal(t, int64(3), absolute[1].Depth)
+		assert.Equal(t, int64(3), absolute[1].AbsoluteDepth)
+	}
+}
+
+func TestUsersSwapRole(t *testing.T) {
+	junior, err := rbacTest.Roles().Add("swap_junior", "", 0)
+	assert.Nil(t, err)
+	senior, err := rbacTest.Roles().Add("swap_senior", "", 0)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Users().Assign(junior, int64(1001), nil)
+	assert.Nil(t, err)
+
+	err = rbacTest.Users().SwapRole(int64(1001), junior, senior)
+	assert.Nil(t, err)
+
+	has, err := rbacTest.Users().HasRole(senior, int64(1001))
+	assert.Nil(t, err)
+	assert.True(t, has)
+	has, err = rbacTest.Users().HasRole(junior, int64(1001))
+	assert.Nil(t, err)
+	assert.False(t, has)
+
+	err = rbacTest.Users().SwapRole(int64(1001), junior, "swap_missing_target")
+	assert.Equal(t, ErrTitleNotFound, err)
+
+	// User 1002 doesn't have the junior role, so the new assignment is rolled back.
+	err = rbacTest.Users().SwapRole(int64(1002), junior, senior)
+	assert.Equal(t, ErrNotAssigned, err)
+
+	has, err = rbacTest.Users().HasRole(senior, int64(1002))
+	assert.Nil(t, err)
+	assert.False(t, has)
+}
+
+func TestQueryError(t *testing.T) {
+	_, err := rbacTest.Roles().Add("query_error", "", 123456789)
+
+	var queryErr *QueryError
+	if assert.True(t, errors.As(err, &queryErr)) {
+		assert.Equal(t, "add", queryErr.Op)
+		assert.Equal(t, sql.ErrNoRows, errors.Unwrap(err))
+		assert.Equal(t, "add: "+sql.ErrNoRows.Error(), err.Error())
+	}
+}
+
+func TestRolesIn(t *testing.T) {
+	_, err := rbacTest.DB().Exec("CREATE TABLE IF NOT EXISTS legacy_roles LIKE roles")
+	assert.Nil(t, err)
+	defer rbacTest.DB().Exec("DROP TABLE legacy_roles")
+
+	legacy := rbacTest.RolesIn("legacy_roles")
+	assert.Nil(t, legacy.Reset(true))
+
+	_, err = legacy.AddPath("/legacy/copied", nil)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Roles().GetRoleID("/legacy/copied")
+	assert.Equal(t, ErrPathNotFound, err)
+
+	nodes, err := legacy.Descendants(false, rbacTest.rootID())
+	assert.Nil(t, err)
+	for _, node := range nodes {
+		path, err := legacy.GetPath(node.ID)
+		assert.Nil(t, err)
+
+		_, err = rbacTest.Roles().AddPath(path, nil)
+		assert.Nil(t, err)
+	}
+
+	_, err = rbacTest.Roles().GetRoleID("/legacy/copied")
+	assert.Nil(t, err)
+}
+
+func TestDescendantsOrder(t *testing.T) {
+	parentID, err := rbacTest.Roles().Add("order_parent", "", 0)
+	assert.Nil(t, err)
+
+	for _, title := range []string{"order_c", "order_a", "order_b"} {
+		_, err := rbacTest.Roles().Add(title, "", parentID)
+		assert.Nil(t, err)
+	}
+	_, err = rbacTest.Roles().AddPath("/order_parent/order_c/order_nested", nil)
+	assert.Nil(t, err)
+
+	for i := 0; i < 3; i++ {
+		descendants, err := rbacTest.Roles().Descendants(false, parentID)
+		assert.Nil(t, err)
+
+		var titles []string
+		for _, d := range descendants {
+			titles = append(titles, d.Title)
+		}
+		assert.Equal(t, []string{"order_c", "order_nested", "order_a", "order_b"}, titles)
+	}
+}
+
+func TestNullDescription(t *testing.T) {
+	_, err := rbacTest.DB().Exec("CREATE TABLE IF NOT EXISTS nullable_roles LIKE roles")
+	assert.Nil(t, err)
+	defer rbacTest.DB().Exec("DROP TABLE nullable_roles")
+
+	_, err = rbacTest.DB().Exec("ALTER TABLE nullable_roles MODIFY description text NULL")
+	assert.Nil(t, err)
+
+	roles := rbacTest.RolesIn("nullable_roles")
+	assert.Nil(t, roles.Reset(true))
+
+	id, err := roles.Add("null_description", "", 0)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.DB().Exec("UPDATE nullable_roles SET description=NULL WHERE id=?", id)
+	assert.Nil(t, err)
+
+	description, err := roles.GetDescription(id)
+	assert.Nil(t, err)
+	assert.Equal(t, "", description)
+
+	descendants, err := roles.Descendants(false, rbacTest.rootID())
+	assert.Nil(t, err)
+	if assert.Len(t, descendants, 1) {
+		assert.Equal(t, "", descendants[0].Description)
+	}
+}
+
+func TestIsAncestor(t *testing.T) {
+	_, err := rbacTest.Roles().AddPath("/ancestry/left", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Roles().AddPath("/ancestry/right", nil)
+	assert.Nil(t, err)
+
+	left, err := rbacTest.Roles().GetRoleID("/ancestry/left")
+	assert.Nil(t, err)
+	right, err := rbacTest.Roles().GetRoleID("/ancestry/right")
+	assert.Nil(t, err)
+
+	is, err := rbacTest.Roles().IsAncestor(rbacTest.rootID(), left)
+	assert.Nil(t, err)
+	assert.True(t, is)
+
+	is, err = rbacTest.Roles().IsDescendant(left, rbacTest.rootID())
+	assert.Nil(t, err)
+	assert.True(t, is)
+
+	is, err = rbacTest.Roles().IsAncestor(left, right)
+	assert.Nil(t, err)
+	assert.False(t, is)
+
+	is, err = rbacTest.Roles().IsAncestor(right, left)
+	assert.Nil(t, err)
+	assert.False(t, is)
+
+	is, err = rbacTest.Roles().IsAncestor(left, left)
+	assert.Nil(t, err)
+	assert.False(t, is)
+}
+
+func TestUsersTable(t *testing.T) {
+	rbac := New(&Config{Name: "smartident", Username: "root", Password: "pass", Host: "localhost", Port: 3306, UsersTable: "fresh_user_roles"})
+	defer rbac.Close()
+	defer rbac.DB().Exec("DROP TABLE fresh_user_roles")
+
+	assert.Nil(t, rbac.Migrate())
+	assert.Equal(t, "fresh_user_roles", rbac.Users().Table())
+
+	roleID, err := rbac.Roles().Add("fresh_users_role", "", 0)
+	assert.Nil(t, err)
+
+	_, err = rbac.Users().Assign(roleID, int64(1101), nil)
+	assert.Nil(t, err)
+
+	has, err := rbac.Users().HasRole(roleID, int64(1101))
+	assert.Nil(t, err)
+	assert.True(t, has)
+
+	has, err = rbacTest.Users().HasRole(roleID, int64(1101))
+	assert.Nil(t, err)
+	assert.False(t, has)
+}
+
+func TestEnsureRoot(t *testing.T) {
+	before, err := rbacTest.Roles().Count()
+	assert.Nil(t, err)
+
+	assert.Nil(t, rbacTest.EnsureRoot())
+
+	after, err := rbacTest.Roles().Count()
+	assert.Nil(t, err)
+	assert.Equal(t, before, after)
+
+	_, err = rbacTest.DB().Exec("CREATE TABLE IF NOT EXISTS empty_roles LIKE roles")
+	assert.Nil(t, err)
+	defer rbacTest.DB().Exec("DROP TABLE empty_roles")
+
+	empty := rbacTest.RolesIn("empty_roles")
+	assert.Nil(t, empty.entity.ensureRoot())
+
+	title, err := empty.GetTitle(rbacTest.rootID())
+	assert.Nil(t, err)
+	assert.Equal(t, "root", title)
+
+	_, err = empty.Add("below_root", "", 0)
+	assert.Nil(t, err)
+}
+
+func TestAssignments(t *testing.T) {
+	roleID, err := rbacTest.Roles().Add("listed_moderator", "", 0)
+	assert.Nil(t, err)
+	permissionID, err := rbacTest.Permissions().Add("listed_delete_posts", "", 0)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Assign(roleID, permissionID)
+	assert.Nil(t, err)
+
+	assignments, err := rbacTest.Assignments(1000, 0)
+	assert.Nil(t, err)
+
+	var found bool
+	for _, a := range assignments {
+		if a.RoleID == roleID {
+			found = true
+			assert.Equal(t, Assignment{roleID, "listed_moderator", permissionID, "listed_delete_posts", AssignmentAllow}, a)
+		}
+	}
+	assert.True(t, found)
+}
+
+func TestResetAssignmentsEmpty(t *testing.T) {
+	rbac := New(&Config{Name: "smartident", Username: "root", Password: "pass", Host: "localhost", Port: 3306})
+	defer rbac.Close()
+
+	_, err := rbac.DB().Exec("CREATE TABLE IF NOT EXISTS role_permissions_backup LIKE role_permissions")
+	assert.Nil(t, err)
+	defer rbac.DB().Exec("DROP TABLE role_permissions_backup")
+	_, err = rbac.DB().Exec("INSERT INTO role_permissions_backup SELECT * FROM role_permissions")
+	assert.Nil(t, err)
+	defer func() {
+		rbac.DB().Exec("DELETE FROM role_permissions")
+		rbac.DB().Exec("INSERT INTO role_permissions SELECT * FROM role_permissions_backup")
+	}()
+
+	assert.Nil(t, rbac.Roles().ResetAssignments(true))
+
+	var count int64
+	err = rbac.DB().QueryRow("SELECT COUNT(*) FROM role_permissions").Scan(&count)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestCheckWithRoles(t *testing.T) {
+	roleID, err := rbacTest.Roles().Add("grouped_role", "", 0)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Permissions().AddPath("/grouped/read", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Permissions().AddPath("/grouped_other", nil)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Assign(roleID, "/grouped")
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Users().Assign(roleID, int64(1201), nil)
+	assert.Nil(t, err)
+
+	roleIDs, err := rbacTest.Users().RoleIDs(int64(1201))
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{roleID}, roleIDs)
+
+	allowed, err := rbacTest.CheckWithRoles("/grouped/read", roleIDs)
+	assert.Nil(t, err)
+	assert.True(t, allowed)
+
+	allowed, err = rbacTest.CheckWithRoles("/grouped_other", roleIDs)
+	assert.Nil(t, err)
+	assert.False(t, allowed)
+
+	allowed, err = rbacTest.CheckWithRoles("/grouped/read", nil)
+	assert.Nil(t, err)
+	assert.False(t, allowed)
+}
+
+func TestResolveMany(t *testing.T) {
+	first, err := rbacTest.Roles().Add("resolve_first", "", 0)
+	assert.Nil(t, err)
+	second, err := rbacTest.Roles().Add("resolve_second", "", 0)
+	assert.Nil(t, err)
+	_, err = rbacTest.Roles().AddPath("/resolve_path/leaf", nil)
+	assert.Nil(t, err)
+	leaf, err := rbacTest.Roles().GetRoleID("/resolve_path/leaf")
+	assert.Nil(t, err)
+
+	ids, err := rbacTest.Roles().ResolveMany([]string{"resolve_first", "resolve_second", "/resolve_path/leaf", "resolve_missing"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int64{"resolve_first": first, "resolve_second": second, "/resolve_path/leaf": leaf}, ids)
+}
+
+func TestSubtreeSize(t *testing.T) {
+	_, err := rbacTest.Roles().AddPath("/size/a/b", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Roles().AddPath("/size/c", nil)
+	assert.Nil(t, err)
+
+	id, err := rbacTest.Roles().GetRoleID("/size")
+	assert.Nil(t, err)
+
+	size, err := rbacTest.Roles().SubtreeSize(id)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), size)
+
+	_, err = rbacTest.Roles().SubtreeSize(123456789)
+	assert.Equal(t, ErrNodeNotFound, err)
+}
+
+func TestLeaves(t *testing.T) {
+	_, err := rbacTest.Permissions().AddPath("/leaves/posts/read", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Permissions().AddPath("/leaves/posts/write", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Permissions().AddPath("/leaves/settings", nil)
+	assert.Nil(t, err)
+
+	id, err := rbacTest.Permissions().GetPermissionID("/leaves")
+	assert.Nil(t, err)
+
+	leaves, err := rbacTest.Permissions().Leaves(id)
+	assert.Nil(t, err)
+
+	var titles []string
+	for _, l := range leaves {
+		titles = append(titles, l.Title)
+	}
+	assert.Equal(t, []string{"read", "write", "settings"}, titles)
+}
+
+func TestRoleCountExpired(t *testing.T) {
+	current, err := rbacTest.Roles().Add("count_current", "", 0)
+	assert.Nil(t, err)
+	expired, err := rbacTest.Roles().Add("count_expired", "", 0)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Users().Assign(current, int64(1301), nil)
+	assert.Nil(t, err)
+
+	validUntil := time.Now().Add(-time.Hour)
+	_, err = rbacTest.Users().AssignMany(expired, []int64{1301}, &validUntil)
+	assert.Nil(t, err)
+
+	count, err := rbacTest.Users().RoleCount(int64(1301))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), count)
+
+	count, err = rbacTest.Users().CountRoles(int64(1301), true)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), count)
+}
+
+func TestCheckUnknownPermission(t *testing.T) {
+	_, err := rbacTest.Check("nonexistent_permision", int64(1401))
+	assert.Equal(t, ErrPermissionNotFound, err)
+
+	_, err = rbacTest.Check("/nonexistent/permission", int64(1401))
+	assert.Equal(t, ErrPermissionNotFound, err)
+
+	_, err = rbacTest.Check(int64(0), int64(1401))
+	assert.Equal(t, ErrPermissionNotFound, err)
+}
+
+func TestSubtreePermissions(t *testing.T) {
+	_, err := rbacTest.Roles().AddPath("/subtree_staff/forum", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Roles().AddPath("/subtree_staff/billing", nil)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Permissions().Add("subtree_moderate", "", 0)
+	assert.Nil(t, err)
+	_, err = rbacTest.Permissions().Add("subtree_invoices", "", 0)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Assign("/subtree_staff/forum", "subtree_moderate")
+	assert.Nil(t, err)
+	_, err = rbacTest.Assign("/subtree_staff/billing", "subtree_invoices")
+	assert.Nil(t, err)
+
+	permissions, err := rbacTest.Roles().SubtreePermissions("/subtree_staff")
+	assert.Nil(t, err)
+
+	var titles []string
+	for _, p := range permissions {
+		titles = append(titles, p.Title)
+	}
+	assert.Equal(t, []string{"subtree_moderate", "subtree_invoices"}, titles)
+}
+
+func TestNewFromDSN(t *testing.T) {
+	rbac := NewFromDSN("mysql", "root:pass@tcp(localhost:3306)/smartident")
+	defer rbac.Close()
+
+	exists, err := rbac.Roles().Exists(rbac.rootID())
+	assert.Nil(t, err)
+	assert.True(t, exists)
+
+	_, err = NewFromDSNE("mysql", "root:pass@tcp(localhost:1)/smartident")
+	assert.NotNil(t, err)
+}
+
+func TestTxSkipsLock(t *testing.T) {
+	done := make(chan error, 1)
+
+	err := rbacTest.Tx(func(tx *Rbac) error {
+		_, err := tx.Roles().Add("tx_lock", "", 0)
+		if err != nil {
+			return err
+		}
+
+		// A table lock held by the transaction would block this reader.
+		go func() {
+			_, err := rbacTest.Permissions().Count()
+			done <- err
+		}()
+
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(2 * time.Second):
+			return errors.New("reader blocked by the transaction")
+		}
+	})
+	assert.Nil(t, err)
+
+	id, err := rbacTest.Roles().TitleID("tx_lock")
+	assert.Nil(t, err)
+	assert.Nil(t, rbacTest.Roles().Remove(id, false, false))
+}
+
+func TestEditByRef(t *testing.T) {
+	id, err := rbacTest.Roles().AddPath("/edit_ref/b", nil)
+	assert.Nil(t, err)
+
+	err = rbacTest.Roles().EditByRef("/edit_ref/b", "edit_ref_c", "renamed by path")
+	assert.Nil(t, err)
+
+	info, err := rbacTest.Roles().Get(id)
+	assert.Nil(t, err)
+	assert.Equal(t, "edit_ref_c", info.Title)
+	assert.Equal(t, "renamed by path", info.Description)
+
+	_, err = rbacTest.Roles().GetRoleID("/edit_ref/b")
+	assert.Equal(t, ErrPathNotFound, err)
+
+	err = rbacTest.Roles().EditByRef("/edit_ref/missing", "x", "")
+	assert.Equal(t, ErrPathNotFound, err)
+}
+
+func TestEnsureAssignment(t *testing.T) {
+	_, err := rbacTest.Roles().Add("reconciled", "", 0)
+	assert.Nil(t, err)
+
+	reconcile := func() (int, error) {
+		var created int
+		for _, permission := range []string{"delete_posts", "edit_posts"} {
+			ok, err := rbacTest.EnsureAssignment("reconciled", permission)
+			if err != nil {
+				return 0, err
+			}
+			if ok {
+				created++
+			}
+		}
+		return created, nil
+	}
+
+	created, err := reconcile()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, created)
+
+	created, err = reconcile()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, created)
+}
+
+func TestDiff(t *testing.T) {
+	_, err := rbacTest.Roles().AddPath("/diff_a/b", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Roles().AddPath("/diff_extra", nil)
+	assert.Nil(t, err)
+
+	toCreate, toDelete, err := rbacTest.Diff([]PathSpec{
+		{Path: "/diff_a/b"},
+		{Path: "/diff_a/c/d"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/diff_a/c", "/diff_a/c/d"}, toCreate)
+	assert.Contains(t, toDelete, "/diff_extra")
+	assert.NotContains(t, toDelete, "/diff_a")
+	assert.NotContains(t, toDelete, "/diff_a/b")
+
+	_, _, err = rbacTest.Diff([]PathSpec{{Path: "diff_a"}})
+	assert.NotNil(t, err)
+}
+
+func TestRemoveMissingNode(t *testing.T) {
+	err := rbacTest.Roles().entity.deleteConditional(987654)
+	assert.Equal(t, sql.ErrNoRows, errors.Unwrap(err))
+
+	err = rbacTest.Roles().entity.deleteSubtreeConditional(987654)
+	assert.Equal(t, sql.ErrNoRows, errors.Unwrap(err))
+
+	id, err := rbacTest.Roles().Add("after_failed_remove", "", 0)
+	assert.Nil(t, err)
+	assert.Nil(t, rbacTest.Roles().Remove(id, false, false))
+}
+
+func BenchmarkAddPaths(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		paths := make([]PathSpec, 100)
+		for j := range paths {
+			paths[j] = PathSpec{Path: fmt.Sprintf("/bench_paths_%d/a/b/c/d/leaf_%d", i, j)}
+		}
+
+		created, err := rbacTest.Roles().AddPaths(paths)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if created != 105 {
+			b.Fatalf("created %d roles, want 105", created)
+		}
+	}
+}
+
+func TestRootID(t *testing.T) {
+	rootID, err := rbacTest.RootID()
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Roles().Add("top_level_role", "", 0)
+	assert.Nil(t, err)
+
+	children, err := rbacTest.Roles().Children(rootID)
+	assert.Nil(t, err)
+
+	var titles []string
+	for _, c := range children {
+		titles = append(titles, c.Title)
+	}
+	assert.Contains(t, titles, "top_level_role")
+
+	rootID, err = rbacTest.PermissionsRootID()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), rootID)
+}
+
+func TestDialectAddQueries(t *testing.T) {
+	mysqlQueries := newAddQueries(MySQL, "roles")
+	assert.Equal(t, "SELECT `rght`, `lft` FROM `roles` WHERE id=? FOR UPDATE", mysqlQueries.parent)
+	assert.Equal(t, "UPDATE `roles` SET `rght` = `rght` + 2 WHERE `rght` >= ?", mysqlQueries.shiftRight)
+	assert.Equal(t, "INSERT INTO `roles` (`rght`, `lft`, `title`, `description`) VALUES (?,?,?,?)", mysqlQueries.insert)
+	assert.False(t, mysqlQueries.returning)
+
+	postgresQueries := newAddQueries(postgres, "roles")
+	assert.Equal(t, `SELECT "rght", "lft" FROM "roles" WHERE id=$1 FOR UPDATE`, postgresQueries.parent)
+	assert.Equal(t, `UPDATE "roles" SET "lft" = "lft" + 2 WHERE "lft" > $1`, postgresQueries.shiftLeft)
+	assert.Equal(t, `INSERT INTO "roles" ("rght", "lft", "title", "description") VALUES ($1,$2,$3,$4) RETURNING "id"`, postgresQueries.insert)
+	assert.True(t, postgresQueries.returning)
+
+	_, err := dialectFor("pgx")
+	assert.Equal(t, ErrUnsupportedDriver, err)
+
+	dialect, err := dialectFor("mysql")
+	assert.Nil(t, err)
+	assert.Equal(t, MySQL, dialect)
+
+	_, err = NewFromDSNE("postgres", "postgres://localhost/rbac")
+	assert.Equal(t, ErrUnsupportedDriver, err)
+}
+
+func TestUsersByRole(t *testing.T) {
+	_, err := rbacTest.Roles().Add("by_role_moderator", "", 0)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Users().Assign("by_role_moderator", int64(1106), nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Users().Assign("by_role_moderator", int64(1105), nil)
+	assert.Nil(t, err)
+
+	users, err := rbacTest.Users().ByRole("by_role_moderator")
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1105, 1106}, users)
+}
+
+func TestUsersByRolePaged(t *testing.T) {
+	_, err := rbacTest.Roles().Add("paged_members", "", 0)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Users().AssignMany("paged_members", []int64{1201, 1202, 1203, 1204, 1205}, nil)
+	assert.Nil(t, err)
+
+	users, total, err := rbacTest.Users().ByRolePaged("paged_members", 2, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, total)
+	assert.Equal(t, []int64{1203, 1204}, users)
+
+	users, total, err = rbacTest.Users().ByRolePaged("paged_members", 2, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, total)
+	assert.Equal(t, []int64{1205}, users)
+}
+
+func TestAssignValidates(t *testing.T) {
+	_, err := rbacTest.Roles().Add("validated_role", "", 0)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Assign("validated_role", "delete_postz")
+	assert.Equal(t, ErrPermissionNotFound, err)
+
+	_, err = rbacTest.Assign("validated_rol", "delete_posts")
+	assert.Equal(t, ErrRoleNotFound, err)
+
+	_, err = rbacTest.Assign(int64(987654), "delete_posts")
+	assert.Equal(t, ErrRoleNotFound, err)
+
+	_, err = rbacTest.AssignIfAbsent("validated_role", int64(987654))
+	assert.Equal(t, ErrPermissionNotFound, err)
+}
+
+func TestExportAssignmentsCSV(t *testing.T) {
+	_, err := rbacTest.Roles().Add("exported_role", "", 0)
+	assert.Nil(t, err)
+	_, err = rbacTest.Assign("exported_role", "delete_posts")
+	assert.Nil(t, err)
+
+	var buf bytes.Buffer
+	err = rbacTest.ExportAssignmentsCSV(&buf)
+	assert.Nil(t, err)
+
+	lines := strings.Split(buf.String(), "\n")
+	assert.Equal(t, "roleTitle,permissionTitle,assignedAt", lines[0])
+
+	var found bool
+	for _, line := range lines {
+		if strings.HasPrefix(line, "exported_role,delete_posts,") {
+			found = true
+
+			assignedAt, err := time.Parse(time.RFC3339, strings.TrimPrefix(line, "exported_role,delete_posts,"))
+			assert.Nil(t, err)
+			assert.WithinDuration(t, time.Now(), assignedAt, time.Minute)
+		}
+	}
+	assert.True(t, found)
+}
+
+func TestOrphanedAssignments(t *testing.T) {
+	roleID, err := rbacTest.Roles().Add("orphaned_role", "", 0)
+	assert.Nil(t, err)
+	_, err = rbacTest.Assign(roleID, "delete_posts")
+	assert.Nil(t, err)
+
+	_, err = rbacTest.DB().Exec("DELETE FROM roles WHERE id=?", roleID)
+	assert.Nil(t, err)
+
+	orphans, err := rbacTest.FindOrphanedAssignments()
+	assert.Nil(t, err)
+
+	var found bool
+	for _, a := range orphans {
+		if a.RoleID == roleID {
+			found = true
+			assert.Equal(t, "", a.RoleTitle)
+			assert.Equal(t, "delete_posts", a.PermissionTitle)
+		}
+	}
+	assert.True(t, found)
+
+	removed, err := rbacTest.PurgeOrphanedAssignments()
+	assert.Nil(t, err)
+	assert.True(t, removed >= 1)
+
+	orphans, err = rbacTest.FindOrphanedAssignments()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(orphans))
+
+	assert.Nil(t, rbacTest.RebuildTree("roles"))
+}
+
+func TestAssignTyped(t *testing.T) {
+	roleID, err := rbacTest.Roles().Add("typed_role", "", 0)
+	assert.Nil(t, err)
+	permissionID, err := rbacTest.Permissions().Add("typed_permission", "", 0)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.AssignByID(roleID, permissionID)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.AssignByTitle("typed_role", "delete_posts")
+	assert.Nil(t, err)
+
+	count, err := rbacTest.Roles().PermissionCount(roleID)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func TestResetExcept(t *testing.T) {
+	_, err := rbacTest.Roles().AddPath("/system/admin", []string{"System roles", "Administrators"})
+	assert.Nil(t, err)
+	_, err = rbacTest.Roles().Add("reset_except_gone", "", 0)
+	assert.Nil(t, err)
+
+	err = rbacTest.ResetExcept([]string{"/system/admin"})
+	assert.Nil(t, err)
+
+	id, err := rbacTest.Roles().GetRoleID("/system/admin")
+	assert.Nil(t, err)
+
+	description, err := rbacTest.Roles().GetDescription(id)
+	assert.Nil(t, err)
+	assert.Equal(t, "Administrators", description)
+
+	_, err = rbacTest.Roles().TitleID("reset_except_gone")
+	assert.Equal(t, ErrTitleNotFound, err)
+
+	count, err := rbacTest.Roles().Count()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), count)
+}
+
+func TestDepthHistogram(t *testing.T) {
+	_, err := rbacTest.Roles().AddPaths([]PathSpec{
+		{Path: "/histogram/a/x"},
+		{Path: "/histogram/a/y"},
+		{Path: "/histogram/b/z"},
+		{Path: "/histogram/c"},
+	})
+	assert.Nil(t, err)
+
+	id, err := rbacTest.Roles().GetRoleID("/histogram")
+	assert.Nil(t, err)
+
+	histogram, err := rbacTest.Roles().DepthHistogram(id)
+	assert.Nil(t, err)
+	assert.Equal(t, map[int64]int64{1: 3, 2: 3}, histogram)
+
+	leaf, err := rbacTest.Roles().GetRoleID("/histogram/c")
+	assert.Nil(t, err)
+
+	histogram, err = rbacTest.Roles().DepthHistogram(leaf)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(histogram))
+
+	_, err = rbacTest.Roles().DepthHistogram(987654)
+	assert.Equal(t, ErrNodeNotFound, err)
+}
+
+func TestDeepPath(t *testing.T) {
+	var path string
+	for i := 0; i < 20; i++ {
+		path += fmt.Sprintf("/deep_path_level_%02d_%s", i, strings.Repeat("x", 40))
+	}
+
+	_, err := rbacTest.Roles().AddPath(path, nil)
+	assert.Nil(t, err)
+
+	id, err := rbacTest.Roles().GetRoleID(path)
+	assert.Nil(t, err)
+
+	resolved, err := rbacTest.Roles().GetPath(id)
+	assert.Nil(t, err)
+	assert.Equal(t, path, resolved)
+}
+
+func TestRaw(t *testing.T) {
+	id, err := rbacTest.Roles().Add("raw_role", "", 0)
+	assert.Nil(t, err)
+
+	rawID, left, right, err := rbacTest.Roles().Raw(id)
+	assert.Nil(t, err)
+	assert.Equal(t, id, rawID)
+	assert.Equal(t, left+1, right)
+
+	_, rootLeft, rootRight, err := rbacTest.Roles().Raw(rbacTest.rootID())
+	assert.Nil(t, err)
+	assert.True(t, rootLeft < left && right < rootRight)
+
+	_, _, _, err = rbacTest.Roles().Raw(987654)
+	assert.Equal(t, ErrNodeNotFound, err)
+}
+
+func TestLongDescription(t *testing.T) {
+	description := strings.Repeat("long description ", 120)
+	title := strings.Repeat("t", 255)
+
+	id, err := rbacTest.Roles().Add(title, description, 0)
+	assert.Nil(t, err)
+
+	info, err := rbacTest.Roles().Get(id)
+	assert.Nil(t, err)
+	assert.Equal(t, title, info.Title)
+	assert.Equal(t, description, info.Description)
+}
+
+func TestRolesInAddPaths(t *testing.T) {
+	_, err := rbacTest.DB().Exec("CREATE TABLE IF NOT EXISTS custom_roles LIKE roles")
+	assert.Nil(t, err)
+	defer rbacTest.DB().Exec("DROP TABLE custom_roles")
+
+	custom := rbacTest.RolesIn("custom_roles")
+	assert.Nil(t, custom.Reset(true))
+
+	before, err := rbacTest.Roles().Count()
+	assert.Nil(t, err)
+
+	created, err := custom.AddPaths([]PathSpec{{Path: "/custom/a"}, {Path: "/custom/b"}})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), created)
+
+	count, err := custom.Count()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), count)
+
+	after, err := rbacTest.Roles().Count()
+	assert.Nil(t, err)
+	assert.Equal(t, before, after)
+
+	_, err = rbacTest.Roles().GetRoleID("/custom/a")
+	assert.Equal(t, ErrPathNotFound, err)
+}
+
+func TestRolesMergeDeny(t *testing.T) {
+	sourceID, err := rbacTest.Roles().Add("merge_deny_source", "", 0)
+	assert.Nil(t, err)
+	targetID, err := rbacTest.Roles().Add("merge_deny_target", "", 0)
+	assert.Nil(t, err)
+	permissionID, err := rbacTest.Permissions().Add("merge_deny_permission", "", 0)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.AssignType(sourceID, permissionID, AssignmentDeny)
+	assert.Nil(t, err)
+	_, err = rbacTest.Assign(targetID, permissionID)
+	assert.Nil(t, err)
+
+	err = rbacTest.Roles().Merge(targetID, targetID, false)
+	assert.Equal(t, ErrMergeSelf, err)
+
+	count, err := rbacTest.Roles().PermissionCount(targetID)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	err = rbacTest.Roles().Merge(sourceID, targetID, false)
+	assert.Nil(t, err)
+
+	allowed, err := rbacTest.CheckWithRoles(permissionID, []int64{targetID})
+	assert.Nil(t, err)
+	assert.False(t, allowed)
+}
+
+func TestHasPermissionDeny(t *testing.T) {
+	roleID, err := rbacTest.Roles().Add("has_permission_denied", "", 0)
+	assert.Nil(t, err)
+	allowedID, err := rbacTest.Permissions().Add("has_permission_allowed", "", 0)
+	assert.Nil(t, err)
+	deniedID, err := rbacTest.Permissions().Add("has_permission_deny", "", 0)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Assign(roleID, allowedID)
+	assert.Nil(t, err)
+	_, err = rbacTest.AssignType(roleID, deniedID, AssignmentDeny)
+	assert.Nil(t, err)
+
+	has, err := rbacTest.Roles().HasPermission(roleID, deniedID)
+	assert.Nil(t, err)
+	assert.False(t, has)
+
+	has, err = rbacTest.Roles().HasPermission(roleID, allowedID)
+	assert.Nil(t, err)
+	assert.True(t, has)
+
+	permissions, err := rbacTest.Roles().Permissions(roleID)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(permissions))
+	assert.Equal(t, "has_permission_allowed", permissions[0].Title)
+}
+
+func TestCheckExpiredAssignment(t *testing.T) {
+	roleID, err := rbacTest.Roles().Add("expired_role", "", 0)
+	assert.Nil(t, err)
+	permissionID, err := rbacTest.Permissions().Add("expired_permission", "", 0)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Assign(roleID, permissionID)
+	assert.Nil(t, err)
+
+	past := time.Now().Add(-time.Hour)
+	_, err = rbacTest.Users().AssignMany(roleID, []int64{900}, &past)
+	assert.Nil(t, err)
+
+	allowed, err := rbacTest.Check(permissionID, 900)
+	assert.Nil(t, err)
+	assert.False(t, allowed)
+
+	has, err := rbacTest.Users().HasRole(roleID, 900)
+	assert.Nil(t, err)
+	assert.False(t, has)
+
+	roleIDs, err := rbacTest.Users().RoleIDs(900)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(roleIDs))
+}
+
+func TestDryRunRemove(t *testing.T) {
+	rbac := New(&Config{Name: "smartident", Username: "root", Password: "pass", Host: "localhost", Port: 3306, DryRun: true})
+	defer rbac.Close()
+
+	childID, err := rbacTest.Roles().AddPath("/dry_run_a/b", nil)
+	assert.Nil(t, err)
+	parentID, err := rbacTest.Roles().GetRoleID("/dry_run_a")
+	assert.Nil(t, err)
+
+	err = rbac.Roles().Remove("/dry_run_a", true, false)
+	assert.ElementsMatch(t, []int64{parentID, childID}, DryRunIDs(err))
+
+	found, err := rbacTest.Roles().GetRoleID("/dry_run_a/b")
+	assert.Nil(t, err)
+	assert.Equal(t, childID, found)
+
+	count, err := rbacTest.Roles().SubtreeSize(parentID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), count)
+}
+
+type recordingObserver struct {
+	names []string
+	errs  []error
+}
+
+func (o *recordingObserver) ObserveOp(name string, _ time.Duration, err error) {
+	o.names = append(o.names, name)
+	o.errs = append(o.errs, err)
+}
+
+func TestObserver(t *testing.T) {
+	observer := &recordingObserver{}
+	rbac := New(&Config{Name: "smartident", Username: "root", Password: "pass", Host: "localhost", Port: 3306, Observer: observer})
+	defer rbac.Close()
+
+	roleID, err := rbac.Roles().Add("observed_role", "", 0)
+	assert.Nil(t, err)
+	permissionID, err := rbac.Permissions().Add("observed_permission", "", 0)
+	assert.Nil(t, err)
+
+	_, err = rbac.Assign(roleID, permissionID)
+	assert.Nil(t, err)
+
+	err = rbac.Roles().Remove(roleID, false, false)
+	assert.Nil(t, err)
+
+	err = rbac.Roles().Remove(roleID, false, false)
+	assert.NotNil(t, err)
+
+	assert.Equal(t, []string{"Roles.Add", "Permissions.Add", "Assign", "Roles.Remove", "Roles.Remove"}, observer.names)
+	assert.Equal(t, []error{nil, nil, nil, nil, err}, observer.errs)
+}
+
+func TestSchemaFallback(t *testing.T) {
+	rbac := Rbac{schema: &schema{}}
+	assert.Equal(t, "0", rbac.denied("TRel"))
+	assert.Equal(t, "", rbac.allowed("TRel"))
+	assert.Equal(t, "'allow'", rbac.assignmentType("TRel"))
+
+	_, err := rbac.AssignType(1, 1, AssignmentDeny)
+	assert.Equal(t, ErrMigrationRequired, err)
+
+	assert.Equal(t, "", rbac.notExpired("TUR"))
+
+	rbac.schema.denies = true
+	assert.Equal(t, "SUM(TRel.type='deny')", rbac.denied("TRel"))
+	assert.Equal(t, " AND TRel.type='allow'", rbac.allowed("TRel"))
+	assert.Equal(t, "TRel.type", rbac.assignmentType("TRel"))
+
+	rbac.schema.expiry = true
+	assert.Equal(t, " AND (TUR.valid_until IS NULL OR TUR.valid_until > NOW())", rbac.notExpired("TUR"))
+}
+
+func TestAssignIfAbsentClientFoundRows(t *testing.T) {
+	rbac := New(&Config{Name: "smartident", Username: "root", Password: "pass", Host: "localhost", Port: 3306, Params: map[string]string{"clientFoundRows": "true"}})
+	defer rbac.Close()
+
+	roleID, err := rbac.Roles().Add("found_rows", "", 0)
+	assert.Nil(t, err)
+	permissionID, err := rbac.Permissions().Add("found_rows_permission", "", 0)
+	assert.Nil(t, err)
+
+	created, err := rbac.AssignIfAbsent(roleID, permissionID)
+	assert.Nil(t, err)
+	assert.True(t, created)
+
+	created, err = rbac.AssignIfAbsent(roleID, permissionID)
+	assert.Nil(t, err)
+	assert.False(t, created)
+
+	allowed, err := rbac.Roles().HasPermission(roleID, permissionID)
+	assert.Nil(t, err)
+	assert.True(t, allowed)
+}
+
+func TestByRoleExpired(t *testing.T) {
+	roleID, err := rbacTest.Roles().Add("members_expiring", "", 0)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Users().Assign(roleID, int64(1401), nil)
+	assert.Nil(t, err)
+
+	past := time.Now().Add(-time.Hour)
+	_, err = rbacTest.Users().AssignMany(roleID, []int64{1402}, &past)
+	assert.Nil(t, err)
+
+	users, err := rbacTest.Users().ByRole(roleID)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1401}, users)
+
+	users, total, err := rbacTest.Users().ByRolePaged(roleID, 10, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1401}, users)
+	assert.Equal(t, 1, total)
+}
+
+func TestReplicaDSN(t *testing.T) {
+	config := Config{ReplicaDSN: "user:pass@tcp(replica:3306)/rbac"}
+	dsn, err := config.replicaDSN()
+	assert.Nil(t, err)
+	assert.Equal(t, "user:pass@tcp(replica:3306)/rbac?group_concat_max_len=1048576&parseTime=true", dsn)
+
+	config = Config{ReplicaDSN: "user:pass@tcp(replica:3306)/rbac?parseTime=false", Params: map[string]string{"tls": "true"}}
+	dsn, err = config.replicaDSN()
+	assert.Nil(t, err)
+	assert.Equal(t, "user:pass@tcp(replica:3306)/rbac?parseTime=false&group_concat_max_len=1048576&tls=true", dsn)
+
+	config = Config{ReplicaDSN: "not a dsn"}
+	_, err = config.replicaDSN()
+	assert.NotNil(t, err)
+}
+
+func TestActionIDSoftDeleted(t *testing.T) {
+	rbac := New(&Config{Name: "smartident", Username: "root", Password: "pass", Host: "localhost", Port: 3306, SoftDelete: true})
+	defer rbac.Close()
+
+	permissionID, err := rbac.Permissions().AddAction("soft_resource", "soft_action", "")
+	assert.Nil(t, err)
+
+	err = rbac.Permissions().entity.deleteConditional(permissionID)
+	assert.Nil(t, err)
+
+	_, err = rbac.Permissions().ActionID("soft_resource", "soft_action")
+	assert.Equal(t, ErrPermissionNotFound, err)
 }
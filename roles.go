@@ -1,8 +1,10 @@
 package gorbac
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
+	"time"
 )
 
 type Roles struct {
@@ -23,6 +25,7 @@ type Role struct {
 // Error messages for Roles
 var (
 	ErrRowRequired = errors.New("role cannot be nil")
+	ErrMergeSelf   = errors.New("cannot merge a role into itself")
 )
 
 func newRoleManager(r *Rbac) *Roles {
@@ -45,6 +48,7 @@ func (r Roles) Unassign(role RoleInterface, permission PermissionInterface) erro
 }
 
 // HasPermission checks to see if a Role has a Permission or not.
+// Like Check, a deny assigned to the Role or its descendants takes precedence over any allow.
 func (r Roles) HasPermission(role RoleInterface, permission PermissionInterface) (bool, error) {
 	var err error
 	var roleID, permissionID int64
@@ -60,14 +64,14 @@ func (r Roles) HasPermission(role RoleInterface, permission PermissionInterface)
 	}
 
 	query := fmt.Sprintf(`
-		SELECT COUNT(*) AS Result
+		SELECT COUNT(*) AS Result, COALESCE(%s, 0) AS Denied
 		FROM role_permissions AS TRel
 		JOIN permissions AS TP ON ( TP.ID= TRel.permission_id)
 		JOIN roles AS TR ON ( TR.ID = TRel.role_id)
-		WHERE TR.Lft BETWEEN
-			(SELECT Lft FROM roles WHERE ID=?)
+		WHERE TR.%s BETWEEN
+			(SELECT %s FROM roles WHERE ID=?)
 			AND
-			(SELECT Rght FROM roles WHERE ID=?)
+			(SELECT %s FROM roles WHERE ID=?)
 
 			/* the above section means any row that is a descendants of our role (if descendant roles have some permission, then our role has it two) */
 
@@ -76,29 +80,30 @@ func (r Roles) HasPermission(role RoleInterface, permission PermissionInterface)
 				FROM 
 				permissions AS node,
 				permissions AS parent
-			WHERE node.Lft BETWEEN parent.Lft AND parent.Rght
+			WHERE node.%s BETWEEN parent.%s AND parent.%s
 			AND ( node.ID=? )
-			ORDER BY parent.Lft
+			ORDER BY parent.%s
 		);
-	`)
+	`, r.rbac.denied("TRel"), Left, Left, Right, Left, Left, Right, Left)
 
-	var result int64
-	err = r.rbac.db.QueryRow(query, roleID, roleID, permissionID).Scan(&result)
+	var result, denied int64
+	err = r.rbac.db.QueryRow(query, roleID, roleID, permissionID).Scan(&result, &denied)
 	if err != nil {
 		return false, err
 	}
 
-	if result > 0 {
-		return true, nil
-	}
-
-	return false, nil
+	return result > 0 && denied == 0, nil
 }
 
 // Remove Roles from system.
 // If set to true, all descendants of the Permission will also be removed.
-func (r Roles) Remove(role RoleInterface, recursive bool) error {
-	var err error
+// If reassignToParent is set to true, the Permissions of the Role are assigned to its parent.
+// With Config.SoftDelete the Roles are marked as deleted instead, their assignments are still removed.
+// All steps run in a single transaction, the first failing step rolls back the removal and its error is returned.
+// With Config.DryRun nothing is removed and a DryRunError is returned, DryRunIDs returns the IDs it would remove.
+func (r Roles) Remove(role RoleInterface, recursive bool, reassignToParent bool) (err error) {
+	defer r.rbac.observe("Roles.Remove", time.Now(), &err)
+
 	var roleID int64
 
 	roleID, err = r.GetRoleID(role)
@@ -106,26 +111,257 @@ func (r Roles) Remove(role RoleInterface, recursive bool) error {
 		return err
 	}
 
-	r.UnassignPermissions(role)
-	r.UnassignUsers(role)
+	if r.rbac.dryRun {
+		ids := []int64{roleID}
+		if recursive {
+			ids, err = r.subtreeIDs(roleID)
+			if err != nil {
+				return err
+			}
+		}
+
+		return r.rbac.dryRunRemoval(ids, []int64{roleID})
+	}
+
+	return r.rbac.Tx(func(tx *Rbac) error {
+		roles := tx.RolesIn(r.table)
+
+		if reassignToParent {
+			err := roles.reassignPermissions(roleID)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := roles.UnassignPermissions(roleID)
+		if err != nil {
+			return err
+		}
+
+		err = roles.UnassignUsers(roleID)
+		if err != nil {
+			return err
+		}
+
+		if recursive {
+			return roles.entity.deleteSubtreeConditional(roleID)
+		}
+
+		return roles.entity.deleteConditional(roleID)
+	})
+}
+
+// reassignPermissions assigns the Permissions of a Role to its parent, existing assignments are kept.
+func (r Roles) reassignPermissions(roleID int64) error {
+	parentID, err := r.entity.parentNode(roleID)
+	if err != nil {
+		return err
+	}
+
+	if parentID == 0 {
+		return nil
+	}
+
+	columns := "permission_id, assignment_date"
+	if r.rbac.schema.denies {
+		columns += ", type"
+	}
+
+	_, err = r.rbac.db.Exec(fmt.Sprintf(`
+		INSERT IGNORE INTO role_permissions (role_id, %s)
+		SELECT ?, %s FROM role_permissions WHERE role_id=?`, columns, columns), parentID, roleID)
+
+	return err
+}
+
+// RemoveSubtree removes a Role together with the role_permissions and owner
+// assignments of every removed node.
+// If recursive is set to true, all descendants of the Role are removed as well.
+// It runs in a single transaction, nothing is removed when a step fails.
+// With Config.DryRun nothing is removed and a DryRunError is returned, DryRunIDs returns the IDs it would remove.
+func (r Roles) RemoveSubtree(role RoleInterface, recursive bool) (err error) {
+	defer r.rbac.observe("Roles.RemoveSubtree", time.Now(), &err)
+
+	var roleID int64
+
+	roleID, err = r.GetRoleID(role)
+	if err != nil {
+		return err
+	}
 
+	ids := []int64{roleID}
 	if recursive {
-		r.entity.deleteSubtreeConditional(roleID)
-	} else {
-		r.entity.deleteConditional(roleID)
+		ids, err = r.subtreeIDs(roleID)
+		if err != nil {
+			return err
+		}
 	}
 
-	return nil
+	if r.rbac.dryRun {
+		return r.rbac.dryRunRemoval(ids, ids)
+	}
+
+	placeholders, args := inClause(ids)
+
+	return r.rbac.Tx(func(tx *Rbac) error {
+		_, err := tx.db.Exec(fmt.Sprintf("DELETE FROM role_permissions WHERE role_id IN (%s)", placeholders), args...)
+		if err != nil {
+			return err
+		}
+
+		for _, owners := range tx.extensions {
+			_, err = tx.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE role_id IN (%s)", owners.Table(), placeholders), args...)
+			if err != nil {
+				return err
+			}
+		}
+
+		roles := tx.RolesIn(r.table)
+		if recursive {
+			return roles.entity.deleteSubtreeConditional(roleID)
+		}
+
+		return roles.entity.deleteConditional(roleID)
+	})
 }
 
-func (r Roles) Add(title string, description string, parentID int64) (int64, error) {
+// Merge moves all Permissions and owner assignments of source to target,
+// assignments target already has are dropped. A deny of source wins over an allow
+// target has for the same Permission, so merging never grants more than either role denied.
+// If removeSource is set to true, source is removed afterwards. It runs in a single transaction.
+// ErrMergeSelf is returned when source and target are the same Role.
+func (r Roles) Merge(source, target RoleInterface, removeSource bool) (err error) {
+	defer r.rbac.observe("Roles.Merge", time.Now(), &err)
+
+	return r.rbac.Tx(func(tx *Rbac) error {
+		roles := tx.RolesIn(r.table)
+
+		sourceID, err := roles.GetRoleID(source)
+		if err != nil {
+			return err
+		}
+
+		targetID, err := roles.GetRoleID(target)
+		if err != nil {
+			return err
+		}
+
+		if sourceID == targetID {
+			return ErrMergeSelf
+		}
+
+		if tx.schema.denies {
+			_, err = tx.db.Exec(`
+				UPDATE role_permissions AS TTarget
+				JOIN role_permissions AS TSource ON (TSource.permission_id=TTarget.permission_id)
+				SET TTarget.type='deny'
+				WHERE TTarget.role_id=? AND TSource.role_id=? AND TSource.type='deny'`, targetID, sourceID)
+			if err != nil {
+				return err
+			}
+		}
+
+		tables := []string{"role_permissions"}
+		for _, owners := range tx.extensions {
+			tables = append(tables, owners.Table())
+		}
+
+		for _, table := range tables {
+			_, err = tx.db.Exec(fmt.Sprintf("UPDATE IGNORE %s SET role_id=? WHERE role_id=?", table), targetID, sourceID)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE role_id=?", table), sourceID)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = tx.audit("merge", r.table, targetID, sourceID)
+		if err != nil {
+			return err
+		}
+
+		if removeSource {
+			return roles.Remove(sourceID, false, false)
+		}
+
+		return nil
+	})
+}
+
+// subtreeIDs returns the ID of a Role followed by the IDs of all its descendants.
+// It reads from the primary, the result is used to remove assignments.
+func (r Roles) subtreeIDs(roleID int64) ([]int64, error) {
+	query := fmt.Sprintf(`
+		SELECT node.ID
+		FROM %s AS node,
+			%s AS parent
+		WHERE node.%s BETWEEN parent.%s AND parent.%s
+		AND parent.ID=?%s
+		ORDER BY node.%s`, r.table, r.table, Left, Left, Right, r.rbac.notDeleted("node"), Left)
+
+	rows, err := r.rbac.db.Query(query, roleID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+func (r Roles) Add(title string, description string, parentID int64) (_ int64, err error) {
+	defer r.rbac.observe("Roles.Add", time.Now(), &err)
 	return r.entity.add(title, description, parentID)
 }
 
-func (r Roles) AddPath(path string, description []string) (int64, error) {
+// AddPath creates the missing Roles of a path like "/admin/test".
+// Returns the number of Roles created as int64, the same as Permissions().AddPath.
+func (r Roles) AddPath(path string, description []string) (_ int64, err error) {
+	defer r.rbac.observe("Roles.AddPath", time.Now(), &err)
 	return r.entity.addPath(path, description)
 }
 
+// EnsureRole returns the ID of the Role at path, creating it when it doesn't exist yet.
+// Concurrent calls for the same path yield a single Role.
+func (r Roles) EnsureRole(path string, descriptions []string) (_ int64, err error) {
+	defer r.rbac.observe("Roles.EnsureRole", time.Now(), &err)
+	return r.entity.ensurePath(path, descriptions)
+}
+
+// AddPaths creates the missing Roles of all paths in a single transaction.
+// Returns the total number of Roles created, nothing is created when an error is returned.
+// Prefixes shared by several paths are only looked up once.
+func (r Roles) AddPaths(paths []PathSpec) (int64, error) {
+	var created int64
+	err := r.rbac.Tx(func(tx *Rbac) error {
+		var err error
+		created, err = tx.RolesIn(r.table).entity.addPaths(paths)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return created, nil
+}
+
 func (r Roles) TitleID(title string) (int64, error) {
 	return r.entity.titleID(title)
 }
@@ -142,6 +378,7 @@ func (r Roles) ResetAssignments(ensure bool) error {
 	return r.entity.resetAssignments(ensure)
 }
 
+// Permissions returns the Permissions granted directly to a Role, denied Permissions are not included.
 func (r Roles) Permissions(role RoleInterface) ([]permission, error) {
 	var roleID int64
 	var err error
@@ -153,10 +390,10 @@ func (r Roles) Permissions(role RoleInterface) ([]permission, error) {
 
 	query := fmt.Sprintf(`
 	SELECT 
-		TP.ID, TP.Title, TP.Description 
+		TP.ID, TP.%s, TP.%s 
 	FROM permissions AS TP
 	LEFT JOIN role_permissions AS TR ON (TR.permission_id=TP.ID)
-	WHERE role_id=? ORDER BY TP.ID`)
+	WHERE role_id=?%s ORDER BY TP.ID`, Title, Description, r.rbac.allowed("TR"))
 
 	rows, err := r.rbac.db.Query(query, roleID)
 	if err != nil {
@@ -167,17 +404,116 @@ func (r Roles) Permissions(role RoleInterface) ([]permission, error) {
 	var permissions []permission
 	for rows.Next() {
 		var permission permission
-		err := rows.Scan(&permission.ID, &permission.Title, &permission.Description)
+		var description sql.NullString
+		err := rows.Scan(&permission.ID, &permission.Title, &description)
 		if err != nil {
 			return nil, err
 		}
+		permission.Description = description.String
 		permissions = append(permissions, permission)
 	}
 
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
 	return permissions, nil
 
 }
 
+// EffectivePermissions returns the Permissions assigned to a Role or to any of its ancestor Roles.
+// Permissions denied to any of them are left out.
+// The synthetic root Role is left out, its assignment would otherwise show up for every Role.
+func (r Roles) EffectivePermissions(role RoleInterface) ([]path, error) {
+	roleID, err := r.GetRoleID(role)
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf(`
+	SELECT
+		TP.ID, TP.%s, TP.%s
+	FROM role_permissions AS TRel
+	JOIN permissions AS TP ON (TP.ID=TRel.permission_id)
+	JOIN roles AS TR ON (TR.ID=TRel.role_id)
+	JOIN roles AS node ON (node.%s BETWEEN TR.%s AND TR.%s)
+	WHERE node.ID=? AND TR.ID<>?
+	GROUP BY TP.ID
+	HAVING %s = 0
+	ORDER BY TP.%s`, Title, Description, Left, Left, Right, r.rbac.denied("TRel"), Left)
+
+	rows, err := r.rbac.db.Query(query, roleID, r.rbac.rootID())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []path
+	for rows.Next() {
+		var p path
+		var description sql.NullString
+		err := rows.Scan(&p.ID, &p.Title, &description)
+		if err != nil {
+			return nil, err
+		}
+		p.Description = description.String
+		result = append(result, p)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// SubtreePermissions returns the Permissions granted to a Role or to any of its descendant Roles,
+// the same set Check grants a user assigned the Role. Denies are not included.
+func (r Roles) SubtreePermissions(role RoleInterface) ([]path, error) {
+	roleID, err := r.GetRoleID(role)
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf(`
+	SELECT
+		TP.ID, TP.%s, TP.%s
+	FROM roles AS node
+	JOIN roles AS TR ON (TR.%s BETWEEN node.%s AND node.%s)
+	JOIN role_permissions AS TRel ON (TRel.role_id=TR.ID)
+	JOIN permissions AS TP ON (TP.ID=TRel.permission_id)
+	WHERE node.ID=?%s
+	GROUP BY TP.ID
+	ORDER BY TP.%s`, Title, Description, Left, Left, Right, r.rbac.allowed("TRel"), Left)
+
+	rows, err := r.rbac.db.Query(query, roleID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []path
+	for rows.Next() {
+		var p path
+		var description sql.NullString
+		err := rows.Scan(&p.ID, &p.Title, &description)
+		if err != nil {
+			return nil, err
+		}
+		p.Description = description.String
+		result = append(result, p)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
 func (r Roles) UnassignPermissions(role RoleInterface) error {
 	var err error
 	var roleID int64
@@ -196,6 +532,21 @@ func (r Roles) UnassignPermissions(role RoleInterface) error {
 	return nil
 }
 
+// UnassignAll removes every Permission of a Role and returns the number of removed assignments.
+func (r Roles) UnassignAll(role RoleInterface) (int64, error) {
+	roleID, err := r.GetRoleID(role)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := r.rbac.db.Exec("DELETE FROM role_permissions WHERE role_id=?", roleID)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
 func (r Roles) UnassignUsers(role RoleInterface) error {
 	var err error
 	var roleID int64
@@ -204,7 +555,7 @@ func (r Roles) UnassignUsers(role RoleInterface) error {
 	if err != nil {
 		return err
 	}
-	query := fmt.Sprintf("DELETE FROM user_roles WHERE role_id=?")
+	query := fmt.Sprintf("DELETE FROM %s WHERE role_id=?", r.rbac.usersTable)
 	_, err = r.rbac.db.Exec(query, roleID)
 
 	if err != nil {
@@ -220,35 +571,81 @@ func (r Roles) GetRoleID(role RoleInterface) (int64, error) {
 	if _, ok := role.(int64); ok {
 		roleID = role.(int64)
 	} else if _, ok := role.(string); ok {
-
-		if role.(string)[:1] == "/" {
-			roleID, err = r.entity.pathID(role.(string))
-			if err != nil {
-				return 0, err
-			}
-		} else {
-			roleID, err = r.entity.titleID(role.(string))
-
-			if err != nil {
-				return 0, err
-			}
+		roleID, err = r.entity.returnID(role.(string))
+		if err != nil {
+			return 0, err
 		}
 	}
 
 	return roleID, nil
 }
 
+// Exists checks whether a Role exists, a Role that can't be found is not an error.
+func (r Roles) Exists(role RoleInterface) (bool, error) {
+	roleID, err := r.GetRoleID(role)
+	if err == ErrTitleNotFound || err == ErrPathNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return r.entity.exists(roleID)
+}
+
+// PermissionCount returns the number of Permissions directly assigned to a Role.
+func (r Roles) PermissionCount(role RoleInterface) (int, error) {
+	roleID, err := r.GetRoleID(role)
+	if err != nil {
+		return 0, err
+	}
+
+	var result int
+	err = r.rbac.db.QueryRow("SELECT COUNT(*) FROM role_permissions WHERE role_id=?", roleID).Scan(&result)
+	if err != nil {
+		return 0, err
+	}
+
+	return result, nil
+}
+
+// ExistsByPath checks whether a Role exists at path, with Config.CachePaths
+// repeated checks for the same path are answered without a query.
+func (r Roles) ExistsByPath(path string) (bool, error) {
+	_, err := r.entity.pathID(path)
+	if err == ErrPathNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Count returns the number of Roles, the synthetic root is not counted.
 func (r Roles) Count() (int64, error) {
 	return r.entity.count()
 }
 func (r Roles) GetDescription(id int64) (string, error) {
-	return r.entity.getTitle(id)
+	return r.entity.getDescription(id)
 }
 
 func (r Roles) GetTitle(id int64) (string, error) {
 	return r.entity.getTitle(id)
 }
 
+// Get returns the title, description, depth and path of a Role in a single query.
+func (r Roles) Get(id int64) (*NodeInfo, error) {
+	return r.entity.get(id)
+}
+
+// GetMany returns the ID, title and description of several Roles in a single query.
+// IDs that don't exist are missing from the result.
+func (r Roles) GetMany(ids []int64) (map[int64]path, error) {
+	return r.entity.getMany(ids)
+}
+
 func (r Roles) GetPath(id int64) (string, error) {
 	return r.entity.getPath(id)
 }
@@ -257,24 +654,125 @@ func (r Roles) Depth(id int64) (int64, error) {
 	return r.entity.depth(id)
 }
 
-func (r Roles) Edit(id int64, title, description string) error {
+func (r Roles) Edit(id int64, title, description string) (err error) {
+	defer r.rbac.observe("Roles.Edit", time.Now(), &err)
 	return r.entity.edit(id, title, description)
 }
 
+// EditByRef changes the title and description of a Role given as ID, title or path.
+func (r Roles) EditByRef(role RoleInterface, title, description string) (err error) {
+	defer r.rbac.observe("Roles.EditByRef", time.Now(), &err)
+
+	roleID, err := r.GetRoleID(role)
+	if err != nil {
+		return err
+	}
+
+	return r.entity.edit(roleID, title, description)
+}
+
+// Rename changes the title of a Role and leaves its description untouched.
+func (r Roles) Rename(id int64, title string) (err error) {
+	defer r.rbac.observe("Roles.Rename", time.Now(), &err)
+	return r.entity.rename(id, title)
+}
+
+// SetDescription changes the description of a Role and leaves its title untouched.
+func (r Roles) SetDescription(id int64, description string) (err error) {
+	defer r.rbac.observe("Roles.SetDescription", time.Now(), &err)
+	return r.entity.setDescription(id, description)
+}
+
 func (r Roles) ParentNode(id int64) (int64, error) {
 	return r.entity.parentNode(id)
 }
 
+// Parent returns the ID, title and depth of the parent of a Role, or nil for the root.
+func (r Roles) Parent(id int64) (*path, error) {
+	return r.entity.parent(id)
+}
+
+// Ancestors returns the chain from the root to the parent of a Role, ordered by lft.
+func (r Roles) Ancestors(id int64) ([]path, error) {
+	return r.entity.ancestors(id)
+}
+
+// Search returns at most limit Roles whose title starts with prefix, ordered by title.
+func (r Roles) Search(prefix string, limit int) ([]path, error) {
+	return r.entity.search(prefix, limit)
+}
+
 func (r Roles) ReturnID(entity string) (int64, error) {
 	return r.entity.returnID(entity)
 }
 
 // Descendants returns descendants of an Entity, with their depths in integer.
+// Depth is relative to the Entity, so its children have Depth 1, unless absolute is set,
+// then it is the depth below the root. AbsoluteDepth is always the depth below the root.
+// The result is in tree order: each node is followed by its own descendants and
+// siblings are in insertion order, the order is stable across calls.
 func (r Roles) Descendants(absolute bool, id int64) ([]path, error) {
 	return r.entity.descendants(absolute, id)
 }
 
-// Children returns children of an Entity.
+// DescendantsFunc calls fn for every descendant of an Entity without loading them all in memory.
+// Iteration stops when fn returns an error, which is then returned.
+func (r Roles) DescendantsFunc(absolute bool, id int64, fn func(path) error) error {
+	return r.entity.descendantsFunc(absolute, id, fn)
+}
+
+// DescendantsToDepth returns descendants of an Entity at most maxDepth levels deep, with their relative depths.
+func (r Roles) DescendantsToDepth(id int64, maxDepth int64) ([]path, error) {
+	return r.entity.descendantsToDepth(id, maxDepth)
+}
+
+// DescendantsFiltered returns descendants of an Entity whose title and description match the LIKE patterns
+// titleLike and descriptionLike, an empty pattern matches everything. Use EscapeLike for literal input.
+func (r Roles) DescendantsFiltered(id int64, titleLike, descriptionLike string) ([]path, error) {
+	return r.entity.descendantsFiltered(id, titleLike, descriptionLike)
+}
+
+// ResolveMany returns the IDs of many Roles referenced by title or path.
+// All titles are resolved in a single query, Roles that don't exist are missing from the result.
+func (r Roles) ResolveMany(refs []string) (map[string]int64, error) {
+	return r.entity.resolveMany(refs)
+}
+
+// SubtreeSize returns the number of descendants of a Role with a single row lookup.
+func (r Roles) SubtreeSize(id int64) (int64, error) {
+	return r.entity.subtreeSize(id)
+}
+
+// Raw returns the nested set values of a Role as stored, e.g. to debug the errors reported by VerifyTree.
+// Soft-deleted Roles are included, ErrNodeNotFound is returned when there is no row.
+func (r Roles) Raw(id int64) (_, lft, rght int64, err error) {
+	return r.entity.raw(id)
+}
+
+// DepthHistogram counts the descendants of a Role per depth, the children of underID are at depth 1.
+// Returns ErrNodeNotFound when underID doesn't exist.
+func (r Roles) DepthHistogram(underID int64) (map[int64]int64, error) {
+	return r.entity.depthHistogram(underID)
+}
+
+// IsAncestor checks whether ancestorID is above descendantID in the tree.
+// A Role is not its own ancestor, unknown IDs yield false.
+func (r Roles) IsAncestor(ancestorID, descendantID int64) (bool, error) {
+	return r.entity.isAncestor(ancestorID, descendantID)
+}
+
+// IsDescendant checks whether descendantID is below ancestorID in the tree.
+func (r Roles) IsDescendant(descendantID, ancestorID int64) (bool, error) {
+	return r.entity.isAncestor(ancestorID, descendantID)
+}
+
+// Leaves returns the Roles below underID that have no children.
+func (r Roles) Leaves(underID int64) ([]path, error) {
+	return r.entity.leaves(underID)
+}
+
+// Children returns the direct children of a Role, deeper descendants are left out.
+// They are ordered like Descendants.
 func (r Roles) Children(id int64) ([]path, error) {
 	return r.entity.children(id)
 }
@@ -1,3 +1,19 @@
+# Dump of table audit_log
+# ------------------------------------------------------------
+
+CREATE TABLE `audit_log` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `operation` varchar(32) NOT NULL,
+  `entity` varchar(64) NOT NULL,
+  `entity_id` int(11) NOT NULL,
+  `target` text DEFAULT NULL,
+  `actor` varchar(128) NOT NULL DEFAULT '',
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+
+
 # Dump of table permissions
 # ------------------------------------------------------------
 
@@ -5,12 +21,16 @@ CREATE TABLE `permissions` (
   `id` int(11) NOT NULL AUTO_INCREMENT,
   `lft` int(11) NOT NULL,
   `rght` int(11) NOT NULL,
-  `title` char(64) CHARACTER SET utf8 NOT NULL,
+  `title` varchar(255) CHARACTER SET utf8 NOT NULL,
   `description` text CHARACTER SET utf8 NOT NULL,
+  `resource` varchar(64) CHARACTER SET utf8 DEFAULT NULL,
+  `action` varchar(64) CHARACTER SET utf8 DEFAULT NULL,
+  `deleted_at` datetime DEFAULT NULL,
   PRIMARY KEY (`id`),
   KEY `title` (`title`),
   KEY `lft` (`lft`),
-  KEY `rght` (`rght`)
+  KEY `rght` (`rght`),
+  KEY `resource_action` (`resource`,`action`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
 
 
@@ -22,6 +42,7 @@ CREATE TABLE `role_permissions` (
   `role_id` int(11) NOT NULL,
   `permission_id` int(11) NOT NULL,
   `assignment_date` int(11) NOT NULL,
+  `type` enum('allow','deny') NOT NULL DEFAULT 'allow',
   PRIMARY KEY (`role_id`,`permission_id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
 
@@ -34,8 +55,9 @@ CREATE TABLE `roles` (
   `id` int(11) NOT NULL AUTO_INCREMENT,
   `lft` int(11) NOT NULL,
   `rght` int(11) NOT NULL,
-  `Title` varchar(128) CHARACTER SET utf8 NOT NULL,
+  `Title` varchar(255) CHARACTER SET utf8 NOT NULL,
   `description` text CHARACTER SET utf8 NOT NULL,
+  `deleted_at` datetime DEFAULT NULL,
   PRIMARY KEY (`id`),
   KEY `Title` (`Title`),
   KEY `lft` (`lft`),
@@ -51,5 +73,6 @@ CREATE TABLE `user_roles` (
   `user_id` int(11) NOT NULL,
   `role_id` int(11) NOT NULL,
   `assignment_date` int(11) NOT NULL,
+  `valid_until` datetime DEFAULT NULL,
   PRIMARY KEY (`user_id`,`role_id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
@@ -0,0 +1,50 @@
+package gorbac
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// stmtCache holds lazily prepared statements keyed by their SQL.
+type stmtCache struct {
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+func newStmtCache() *stmtCache {
+	return &stmtCache{stmts: make(map[string]*sql.Stmt)}
+}
+
+func (c *stmtCache) prepare(ctx context.Context, db *sql.DB, query string) (*sql.Stmt, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if stmt, ok := c.stmts[query]; ok {
+		return stmt, nil
+	}
+
+	stmt, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	c.stmts[query] = stmt
+
+	return stmt, nil
+}
+
+// close closes all cached statements and empties the cache.
+func (c *stmtCache) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var result error
+	for query, stmt := range c.stmts {
+		if err := stmt.Close(); err != nil && result == nil {
+			result = err
+		}
+		delete(c.stmts, query)
+	}
+
+	return result
+}
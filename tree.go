@@ -0,0 +1,245 @@
+package gorbac
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrUnknownTable is returned when a table is not managed by Rbac.
+var ErrUnknownTable = errors.New("unknown table")
+
+// TreeError describes a node violating the nested set invariants.
+type TreeError struct {
+	ID     int64
+	Left   int64
+	Right  int64
+	Reason string
+}
+
+func (t TreeError) Error() string {
+	return fmt.Sprintf("node %d (%d, %d): %s", t.ID, t.Left, t.Right, t.Reason)
+}
+
+type treeNode struct {
+	ID       int64
+	Left     int64
+	Right    int64
+	children []*treeNode
+}
+
+// VerifyTree checks the nested set invariants of a roles or permissions table.
+// It reports nodes where lft is not lower than rght, duplicate or missing
+// lft/rght values, partially overlapping ranges and more than one root.
+func (r Rbac) VerifyTree(table string) ([]TreeError, error) {
+	nodes, err := r.treeNodes(table, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []TreeError
+
+	seen := make(map[int64]int64, len(nodes)*2)
+	for _, n := range nodes {
+		if n.Left >= n.Right {
+			result = append(result, TreeError{n.ID, n.Left, n.Right, "lft is not lower than rght"})
+		}
+
+		for _, v := range []int64{n.Left, n.Right} {
+			if id, ok := seen[v]; ok {
+				result = append(result, TreeError{n.ID, n.Left, n.Right, fmt.Sprintf("value %d already used by node %d", v, id)})
+				continue
+			}
+			seen[v] = n.ID
+		}
+	}
+
+	for v := int64(0); v < int64(len(nodes)*2); v++ {
+		if _, ok := seen[v]; !ok {
+			result = append(result, TreeError{Reason: fmt.Sprintf("value %d is missing", v)})
+		}
+	}
+
+	var roots int
+	var stack []*treeNode
+	for _, n := range nodes {
+		for len(stack) > 0 && stack[len(stack)-1].Right < n.Left {
+			stack = stack[:len(stack)-1]
+		}
+
+		if len(stack) == 0 {
+			roots++
+			if roots > 1 {
+				result = append(result, TreeError{n.ID, n.Left, n.Right, "node is outside of the root"})
+			}
+		} else if top := stack[len(stack)-1]; n.Right > top.Right {
+			result = append(result, TreeError{n.ID, n.Left, n.Right, fmt.Sprintf("node overlaps node %d", top.ID)})
+		}
+
+		stack = append(stack, n)
+	}
+
+	return result, nil
+}
+
+// RebuildTree recomputes lft and rght of a roles or permissions table.
+// The parent of every node is taken to be the closest node enclosing its lft,
+// nodes outside of the root are moved under the root. Afterwards the values
+// are renumbered so that they are contiguous again.
+// The rows are locked while they are read and rewritten in the same transaction,
+// which is the running one when called inside Tx.
+func (r Rbac) RebuildTree(table string) error {
+	defer r.paths.invalidate(table)
+
+	return r.Tx(func(tx *Rbac) error {
+		return tx.rebuildTree(table)
+	})
+}
+
+func (r Rbac) rebuildTree(table string) error {
+	nodes, err := r.treeNodes(table, true)
+	if err != nil {
+		return err
+	}
+
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	var root *treeNode
+	var stack []*treeNode
+	for _, n := range nodes {
+		if n.ID == r.rootID() {
+			root = n
+		}
+	}
+	if root == nil {
+		root = nodes[0]
+	}
+
+	for _, n := range nodes {
+		if n == root {
+			continue
+		}
+
+		for len(stack) > 0 && stack[len(stack)-1].Right < n.Left {
+			stack = stack[:len(stack)-1]
+		}
+
+		parent := root
+		if len(stack) > 0 {
+			parent = stack[len(stack)-1]
+		}
+		parent.children = append(parent.children, n)
+
+		stack = append(stack, n)
+	}
+
+	var counter int64
+	var number func(n *treeNode)
+	number = func(n *treeNode) {
+		n.Left = counter
+		counter++
+		for _, c := range n.children {
+			number(c)
+		}
+		n.Right = counter
+		counter++
+	}
+	number(root)
+
+	query := fmt.Sprintf("UPDATE %s SET %s = ?, %s = ? WHERE id=?", table, Left, Right)
+	for _, n := range nodes {
+		_, err = r.db.Exec(query, n.Left, n.Right, n.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Diff compares the desired role paths against the current roles tree.
+// The ancestors of a desired path are desired as well. toCreate lists the missing
+// paths with parents before their children, toDelete the existing paths that are not
+// desired, in tree order. Paths are compared case-insensitively with Config.CaseInsensitiveTitles.
+func (r Rbac) Diff(desired []PathSpec) (toCreate, toDelete []string, err error) {
+	current, err := r.roles.entity.paths()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key := func(path string) string {
+		if r.caseInsensitive {
+			return strings.ToLower(path)
+		}
+		return path
+	}
+
+	existing := make(map[string]bool, len(current))
+	for _, path := range current {
+		existing[key(path)] = true
+	}
+
+	wanted := make(map[string]bool, len(desired))
+	for _, spec := range desired {
+		if !isPath(spec.Path) {
+			return nil, nil, fmt.Errorf("invalid path %q", spec.Path)
+		}
+
+		var path string
+		for _, part := range splitPath(spec.Path[1:]) {
+			path += "/" + escapeTitle(part)
+			if wanted[key(path)] {
+				continue
+			}
+			wanted[key(path)] = true
+
+			if !existing[key(path)] {
+				toCreate = append(toCreate, path)
+			}
+		}
+	}
+
+	for _, path := range current {
+		if !wanted[key(path)] {
+			toDelete = append(toDelete, path)
+		}
+	}
+
+	return toCreate, toDelete, nil
+}
+
+// treeNodes returns the nodes of table in lft order, with forUpdate the rows stay locked until the transaction ends.
+func (r Rbac) treeNodes(table string, forUpdate bool) ([]*treeNode, error) {
+	if table != r.roles.getTable() && table != r.permissions.getTable() {
+		return nil, ErrUnknownTable
+	}
+
+	query := fmt.Sprintf("SELECT id, %s, %s FROM %s ORDER BY %s, id", Left, Right, table, Left)
+	if forUpdate {
+		query += " FOR UPDATE"
+	}
+	rows, err := r.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*treeNode
+	for rows.Next() {
+		var n treeNode
+		err := rows.Scan(&n.ID, &n.Left, &n.Right)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, &n)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
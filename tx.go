@@ -0,0 +1,175 @@
+package gorbac
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// dbtx is implemented by both *sql.DB and *sql.Tx.
+type dbtx interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// timeoutDB applies the QueryTimeout to the queries run without a context,
+// the *Context methods keep the deadline of the context they are given.
+type timeoutDB struct {
+	dbtx
+	rbac Rbac
+}
+
+func (t timeoutDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	ctx, cancel := t.rbac.withTimeout(context.Background())
+	defer cancel()
+
+	return t.dbtx.ExecContext(ctx, query, args...)
+}
+
+// Query leaves the context to expire on its own, cancelling it on return would close the rows before they are read.
+func (t timeoutDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	ctx, _ := t.rbac.withTimeout(context.Background())
+
+	return t.dbtx.QueryContext(ctx, query, args...)
+}
+
+// QueryRow leaves the context to expire on its own like Query, the row is only read by Scan.
+func (t timeoutDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	ctx, _ := t.rbac.withTimeout(context.Background())
+
+	return t.dbtx.QueryRowContext(ctx, query, args...)
+}
+
+// timed returns db with the QueryTimeout applied, or db itself when it is disabled.
+func (r Rbac) timed(db dbtx) dbtx {
+	if r.timeout <= 0 {
+		return db
+	}
+
+	return timeoutDB{dbtx: db, rbac: r}
+}
+
+// Tx runs fn in a single database transaction. Tree mutations and assignments
+// made through the Rbac passed to fn are committed together when fn returns nil
+// and rolled back otherwise.
+// Owner extensions other than the default users are not bound to the transaction.
+// With Config.MaxRetries the transaction is retried on deadlocks and lock wait
+// timeouts, so fn may run more than once and must not have side effects outside of tx.
+func (r *Rbac) Tx(fn func(tx *Rbac) error) (err error) {
+	if r.tx != nil {
+		return fn(r)
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = r.runTx(fn)
+		if attempt >= r.maxRetries || !retryable(err) {
+			return err
+		}
+
+		time.Sleep(time.Duration(10<<uint(attempt)) * time.Millisecond)
+	}
+}
+
+// retryable reports whether err is a deadlock or lock wait timeout, after
+// which MySQL has rolled back the statement and the transaction can be tried again.
+func retryable(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+
+	return mysqlErr.Number == 1213 || mysqlErr.Number == 1205
+}
+
+func (r *Rbac) runTx(fn func(tx *Rbac) error) (err error) {
+	tx, err := r.pool.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	err = fn(r.withTx(tx))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	defer r.paths.clear()
+
+	return tx.Commit()
+}
+
+// withTx returns a copy of r running all queries in tx.
+func (r *Rbac) withTx(tx *sql.Tx) *Rbac {
+	rbac := r.clone()
+
+	rbac.db = rbac.timed(tx)
+	rbac.tx = tx
+
+	return rbac
+}
+
+// clone returns a copy of r with its own managers.
+func (r *Rbac) clone() *Rbac {
+	var rbac = new(Rbac)
+	*rbac = *r
+	rbac.bind()
+
+	return rbac
+}
+
+// bind points the managers and the default users extension at r.
+func (r *Rbac) bind() {
+	r.roles = newRoleManager(r)
+	r.permissions = newPermissions(r)
+	r.users = newUsers(r)
+
+	extensions := make(map[string]Owners, len(r.extensions))
+	for name, extension := range r.extensions {
+		extensions[name] = extension
+	}
+	extensions["users"] = newUsers(r)
+	r.extensions = extensions
+}
+
+// prepare returns the cached prepared statement for a read query, bound to the
+// transaction if there is one and to the replica otherwise, if configured.
+func (r Rbac) prepare(ctx context.Context, query string) (*sql.Stmt, error) {
+	if r.tx == nil && r.replica != nil {
+		return r.replicaStmts.prepare(ctx, r.replica, query)
+	}
+
+	stmt, err := r.stmts.prepare(ctx, r.pool, query)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.tx != nil {
+		return r.tx.StmtContext(ctx, stmt), nil
+	}
+
+	return stmt, nil
+}
+
+// reader returns the connection for read-only queries, the replica unless
+// there is none or a transaction is running.
+func (r Rbac) reader() dbtx {
+	if r.tx == nil && r.replica != nil {
+		return r.timed(r.replica)
+	}
+
+	return r.db
+}
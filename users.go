@@ -1,10 +1,12 @@
 package gorbac
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 )
 
@@ -13,6 +15,8 @@ type UserInterface interface{}
 
 type Owner interface{}
 
+// Owners is implemented by the owner extensions registered with AddOwnerExtension.
+// Users, the default extension, has more methods, use Rbac.Users to reach them.
 type Owners interface {
 	Assign(role RoleInterface, owner Owner, meta interface{}) (int64, error)
 	HasRole(role RoleInterface, owner Owner) (bool, error)
@@ -32,7 +36,7 @@ var ErrUserRequired = errors.New("user id is a required argument")
 
 func newUsers(r *Rbac) Users {
 	var users = Users{}
-	users.table = "user_roles"
+	users.table = r.usersTable
 	users.rbac = r
 	return users
 }
@@ -42,8 +46,9 @@ func (u Users) Table() string {
 }
 
 // Assigns a role to a user
-func (u Users) Assign(role RoleInterface, userID Owner, _ interface{}) (int64, error) {
-	var err error
+func (u Users) Assign(role RoleInterface, userID Owner, _ interface{}) (_ int64, err error) {
+	defer u.rbac.observe("Users.Assign", time.Now(), &err)
+
 	var roleID int64
 
 	if _, ok := userID.(string); ok {
@@ -56,39 +61,97 @@ func (u Users) Assign(role RoleInterface, userID Owner, _ interface{}) (int64, e
 		}
 	}
 
-	if _, ok := role.(int64); ok {
-		roleID = role.(int64)
-	} else if _, ok := role.(string); ok {
-		if role.(string)[:1] == "/" {
-			roleID, err = u.rbac.Roles().GetRoleID(role.(string))
-			if err != nil {
-				return 0, err
-			}
-		} else {
-			roleID, err = u.rbac.Roles().TitleID(role.(string))
-			if err != nil {
-				return 0, err
-			}
-		}
+	roleID, err = u.rbac.Roles().GetRoleID(role)
+	if err != nil {
+		return 0, err
 	}
 
 	if roleID > 0 {
 		var query = fmt.Sprintf("INSERT INTO %s (user_id, role_id, assignment_date) VALUES(?,?,?)", u.getTable())
-		res, err := u.rbac.db.Exec(query, userID, roleID, time.Now().Nanosecond())
+		res, err := u.rbac.db.Exec(query, userID, roleID, assignmentDate())
 		if err != nil {
+			if u.assigned(roleID, userID) {
+				return 0, ErrAlreadyAssigned
+			}
 			return 0, err
 		}
 
 		insertID, _ := res.LastInsertId()
 
+		err = u.rbac.audit("assign", u.getTable(), roleID, userID)
+		if err != nil {
+			return 0, err
+		}
+
 		return insertID, nil
 	}
 
 	return 0, fmt.Errorf("role could not be found")
 }
 
+// Assigns a role to many users with a single insert, users already having the role are skipped.
+// Returns the number of new assignments.
+// A validUntil returns ErrMigrationRequired until Migrate has added the valid_until column.
+func (u Users) AssignMany(role RoleInterface, userIDs []int64, validUntil *time.Time) (_ int64, err error) {
+	defer u.rbac.observe("Users.AssignMany", time.Now(), &err)
+
+	if len(userIDs) == 0 {
+		return 0, nil
+	}
+
+	if validUntil != nil && !u.rbac.schema.expiry {
+		return 0, ErrMigrationRequired
+	}
+
+	roleID, err := u.rbac.Roles().GetRoleID(role)
+	if err != nil {
+		return 0, err
+	}
+
+	if roleID == 0 {
+		return 0, fmt.Errorf("role could not be found")
+	}
+
+	var values []string
+	var args []interface{}
+	date := assignmentDate()
+	for _, userID := range userIDs {
+		if userID == 0 {
+			return 0, ErrUserRequired
+		}
+
+		if u.rbac.schema.expiry {
+			values = append(values, "(?,?,?,?)")
+			args = append(args, userID, roleID, date, validUntil)
+		} else {
+			values = append(values, "(?,?,?)")
+			args = append(args, userID, roleID, date)
+		}
+	}
+
+	columns := "user_id, role_id, assignment_date"
+	if u.rbac.schema.expiry {
+		columns += ", valid_until"
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s ON DUPLICATE KEY UPDATE user_id=user_id", u.getTable(), columns, strings.Join(values, ","))
+	res, err := u.rbac.db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	err = u.rbac.audit("assign_many", u.getTable(), roleID, userIDs)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
 // Checks to see whether a UserInterface has a Role or not.
-func (u Users) HasRole(role RoleInterface, userID Owner) (bool, error) {
+func (u Users) HasRole(role RoleInterface, userID Owner) (_ bool, err error) {
+	defer u.rbac.observe("Users.HasRole", time.Now(), &err)
+
 	if _, ok := userID.(string); ok {
 		if userID.(string) == "" {
 			return false, ErrUserRequired
@@ -105,14 +168,19 @@ func (u Users) HasRole(role RoleInterface, userID Owner) (bool, error) {
 	}
 
 	query := fmt.Sprintf(`
-	SELECT COUNT(*) FROM user_roles AS TUR
+	SELECT COUNT(*) FROM %s AS TUR
 	JOIN roles AS TRdirect ON (TRdirect.ID=TUR.role_id)
-	JOIN roles AS TR ON (TR.Lft BETWEEN TRdirect.Lft AND TRdirect.Rght)
+	JOIN roles AS TR ON (TR.%s BETWEEN TRdirect.%s AND TRdirect.%s)
 	WHERE
-	TUR.user_id=? AND TR.ID=?`)
+	TUR.user_id=? AND TR.ID=?%s`, u.getTable(), Left, Left, Right, u.rbac.notExpired("TUR"))
+
+	stmt, err := u.rbac.prepare(context.Background(), query)
+	if err != nil {
+		return false, err
+	}
 
 	var result int64
-	err = u.rbac.db.QueryRow(query, userID, roleID).Scan(&result)
+	err = stmt.QueryRow(userID, roleID).Scan(&result)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			return false, err
@@ -126,8 +194,46 @@ func (u Users) HasRole(role RoleInterface, userID Owner) (bool, error) {
 	return false, nil
 }
 
+// Checks whether a User has been assigned a Role or any of its descendants,
+// e.g. a User assigned "/staff/forum/mod" has a Role in the subtree of "/staff".
+func (u Users) HasRoleInSubtree(role RoleInterface, userID Owner) (_ bool, err error) {
+	defer u.rbac.observe("Users.HasRoleInSubtree", time.Now(), &err)
+
+	if _, ok := userID.(string); ok {
+		if userID.(string) == "" {
+			return false, ErrUserRequired
+		}
+	} else if _, ok := userID.(int64); ok {
+		if userID.(int64) == 0 {
+			return false, ErrUserRequired
+		}
+	}
+
+	roleID, err := u.rbac.Roles().GetRoleID(role)
+	if err != nil {
+		return false, err
+	}
+
+	query := fmt.Sprintf(`
+	SELECT COUNT(*) FROM %s AS TUR
+	JOIN roles AS TRassigned ON (TRassigned.ID=TUR.role_id)
+	JOIN roles AS TR ON (TRassigned.%s BETWEEN TR.%s AND TR.%s)
+	WHERE
+	TUR.user_id=? AND TR.ID=?%s`, u.getTable(), Left, Left, Right, u.rbac.notExpired("TUR"))
+
+	var result int64
+	err = u.rbac.reader().QueryRow(query, userID, roleID).Scan(&result)
+	if err != nil {
+		return false, err
+	}
+
+	return result > 0, nil
+}
+
 // Unassigns a Role from a User interface.
-func (u Users) Unassign(role RoleInterface, userID Owner) error {
+func (u Users) Unassign(role RoleInterface, userID Owner) (err error) {
+	defer u.rbac.observe("Users.Unassign", time.Now(), &err)
+
 	if _, ok := userID.(string); ok {
 		if userID.(string) == "" {
 			return ErrUserRequired
@@ -143,12 +249,74 @@ func (u Users) Unassign(role RoleInterface, userID Owner) error {
 		return err
 	}
 
-	_, err = u.rbac.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE user_id=? AND role_id=?", u.getTable()), userID, roleID)
+	res, err := u.rbac.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE user_id=? AND role_id=?", u.getTable()), userID, roleID)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return ErrNotAssigned
+	}
+
+	return u.rbac.audit("unassign", u.getTable(), roleID, userID)
+}
+
+// Unassigns every Role from a User, e.g. when offboarding.
+// Returns the number of removed assignments.
+func (u Users) UnassignAll(userID Owner) (_ int64, err error) {
+	defer u.rbac.observe("Users.UnassignAll", time.Now(), &err)
+
+	if _, ok := userID.(string); ok {
+		if userID.(string) == "" {
+			return 0, ErrUserRequired
+		}
+	} else if _, ok := userID.(int64); ok {
+		if userID.(int64) == 0 {
+			return 0, ErrUserRequired
+		}
+	}
+
+	res, err := u.rbac.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE user_id=?", u.getTable()), userID)
+	if err != nil {
+		return 0, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	err = u.rbac.audit("unassign_all", u.getTable(), 0, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return affected, nil
+}
+
+// Replaces a Role of a User by another one in a single transaction, so the User
+// never lacks both. Nothing changes when either step fails.
+func (u Users) SwapRole(userID Owner, oldRole, newRole RoleInterface) (err error) {
+	defer u.rbac.observe("Users.SwapRole", time.Now(), &err)
+
+	return u.rbac.Tx(func(tx *Rbac) error {
+		users := Users{rbac: tx, table: u.table}
+
+		_, err := users.Assign(newRole, userID, nil)
+		if err != nil {
+			return err
+		}
+
+		return users.Unassign(oldRole, userID)
+	})
+}
+
+// assigned reports whether a user has been directly assigned a role.
+func (u Users) assigned(roleID int64, userID Owner) bool {
+	var result int64
+	err := u.rbac.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE user_id=? AND role_id=?", u.getTable()), userID, roleID).Scan(&result)
+
+	return err == nil && result > 0
 }
 
 // Returns all Roles of a User.
@@ -165,14 +333,14 @@ func (u Users) AllRoles(userID Owner, _ interface{}) ([]Role, error) {
 
 	query := fmt.Sprintf(`
 		SELECT
-			TR.ID, TR.Title, TR.Description
+			TR.ID, TR.%s, TR.%s
 		FROM
 			%s AS TRel
 		JOIN roles AS TR ON
 		(TRel.role_id=TR.ID)
-		WHERE TRel.user_id=?`, u.getTable())
+		WHERE TRel.user_id=?%s`, Title, Description, u.getTable(), u.rbac.notExpired("TRel"))
 
-	rows, err := u.rbac.db.Query(query, userID)
+	rows, err := u.rbac.reader().Query(query, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -181,17 +349,136 @@ func (u Users) AllRoles(userID Owner, _ interface{}) ([]Role, error) {
 	var roles []Role
 	for rows.Next() {
 		var role Role
-		err := rows.Scan(&role.ID, &role.Title, &role.Description)
+		var description sql.NullString
+		err := rows.Scan(&role.ID, &role.Title, &description)
 		if err != nil {
 			return nil, err
 		}
+		role.Description = description.String
 		roles = append(roles, role)
 	}
 
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
 	return roles, nil
 }
 
+// Returns all Roles of a User including their depth and path.
+func (u Users) RolesDetailed(userID Owner) ([]path, error) {
+	if _, ok := userID.(string); ok {
+		if userID.(string) == "" {
+			return nil, ErrUserRequired
+		}
+	} else if _, ok := userID.(int64); ok {
+		if userID.(int64) == 0 {
+			return nil, ErrUserRequired
+		}
+	}
+
+	query := fmt.Sprintf(`
+		SELECT
+			node.ID, node.%s, node.%s, COUNT(parent.ID)-1 AS Depth,
+			%s AS Path
+		FROM
+			%s AS TRel
+		JOIN roles AS node ON (TRel.role_id=node.ID)
+		JOIN roles AS parent ON (node.%s BETWEEN parent.%s AND parent.%s)
+		WHERE TRel.user_id=?%s
+		GROUP BY node.ID
+		ORDER BY node.%s`, Title, Description, titleConcat, u.getTable(), Left, Left, Right, u.rbac.notExpired("TRel"), Left)
+
+	rows, err := u.rbac.reader().Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []path
+	for rows.Next() {
+		var p path
+		var description sql.NullString
+		err := rows.Scan(&p.ID, &p.Title, &description, &p.Depth, &p.Path)
+		if err != nil {
+			return nil, err
+		}
+		p.Description = description.String
+		p.Path = concatPath(p.Path)
+		result = append(result, p)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Returns the distinct Permissions a User has through its Roles, the same set Check grants:
+// Permissions of the assigned Roles and their descendant Roles, including descendant Permissions,
+// without the denied ones.
+func (u Users) Permissions(userID Owner) ([]path, error) {
+	if _, ok := userID.(string); ok {
+		if userID.(string) == "" {
+			return nil, ErrUserRequired
+		}
+	} else if _, ok := userID.(int64); ok {
+		if userID.(int64) == 0 {
+			return nil, ErrUserRequired
+		}
+	}
+
+	query := fmt.Sprintf(`
+		SELECT
+			TPdirect.ID, TPdirect.%s, TPdirect.%s
+		FROM
+			%s AS TUrel
+		JOIN roles AS TRdirect ON (TRdirect.ID=TUrel.role_id)
+		JOIN roles AS TR ON (TR.%s BETWEEN TRdirect.%s AND TRdirect.%s)
+		JOIN role_permissions AS TRel ON (TR.ID=TRel.role_id)
+		JOIN permissions AS TP ON (TP.ID=TRel.permission_id)
+		JOIN permissions AS TPdirect ON (TPdirect.%s BETWEEN TP.%s AND TP.%s)
+		WHERE TUrel.user_id=?%s%s
+		GROUP BY TPdirect.ID
+		HAVING %s = 0
+		ORDER BY TPdirect.%s`, Title, Description, u.getTable(), Left, Left, Right, Left, Left, Right, u.rbac.notExpired("TUrel"), u.rbac.notDeleted("TPdirect"), u.rbac.denied("TRel"), Left)
+
+	rows, err := u.rbac.reader().Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []path
+	for rows.Next() {
+		var p path
+		var description sql.NullString
+		err := rows.Scan(&p.ID, &p.Title, &description)
+		if err != nil {
+			return nil, err
+		}
+		p.Description = description.String
+		result = append(result, p)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Returns the number of Roles assigned to a User, assignments past their valid_until are not counted.
 func (u Users) RoleCount(userID Owner) (int64, error) {
+	return u.CountRoles(userID, false)
+}
+
+// CountRoles is like RoleCount, assignments past their valid_until are only counted with includeExpired.
+func (u Users) CountRoles(userID Owner, includeExpired bool) (int64, error) {
 	if _, ok := userID.(string); ok {
 		if userID.(string) == "" {
 			return 0, ErrUserRequired
@@ -202,8 +489,13 @@ func (u Users) RoleCount(userID Owner) (int64, error) {
 		}
 	}
 
+	var expired string
+	if !includeExpired {
+		expired = u.rbac.notExpired("")
+	}
+
 	var result int64
-	err := u.rbac.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) AS Result FROM %s WHERE user_id=?", u.getTable()), userID).Scan(&result)
+	err := u.rbac.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) AS Result FROM %s WHERE user_id=?%s", u.getTable(), expired), userID).Scan(&result)
 
 	if err != nil {
 		return 0, err
@@ -212,6 +504,100 @@ func (u Users) RoleCount(userID Owner) (int64, error) {
 	return result, err
 }
 
+// Returns the IDs of the Roles assigned to a User, e.g. to pass to CheckWithRoles.
+func (u Users) RoleIDs(userID Owner) ([]int64, error) {
+	if _, ok := userID.(string); ok {
+		if userID.(string) == "" {
+			return nil, ErrUserRequired
+		}
+	} else if _, ok := userID.(int64); ok {
+		if userID.(int64) == 0 {
+			return nil, ErrUserRequired
+		}
+	}
+
+	rows, err := u.rbac.reader().Query(fmt.Sprintf("SELECT role_id FROM %s WHERE user_id=?%s ORDER BY role_id", u.getTable(), u.rbac.notExpired("")), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []int64
+	for rows.Next() {
+		var id int64
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, id)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// ByRole returns the IDs of the users directly assigned a role, ordered by ID.
+// Assignments past their valid_until are left out.
+func (u Users) ByRole(role RoleInterface) ([]int64, error) {
+	roleID, err := u.rbac.Roles().GetRoleID(role)
+	if err != nil {
+		return nil, err
+	}
+
+	return u.userIDs(fmt.Sprintf("SELECT user_id FROM %s WHERE role_id=?%s ORDER BY user_id", u.getTable(), u.rbac.notExpired("")), roleID)
+}
+
+// ByRolePaged returns a page of the users directly assigned a role, ordered by ID,
+// together with the total number of users assigned the role. Like ByRole, expired assignments are left out.
+func (u Users) ByRolePaged(role RoleInterface, limit, offset int) ([]int64, int, error) {
+	roleID, err := u.rbac.Roles().GetRoleID(role)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var total int
+	err = u.rbac.reader().QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE role_id=?%s", u.getTable(), u.rbac.notExpired("")), roleID).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	result, err := u.userIDs(fmt.Sprintf("SELECT user_id FROM %s WHERE role_id=?%s ORDER BY user_id LIMIT ? OFFSET ?", u.getTable(), u.rbac.notExpired("")), roleID, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return result, total, nil
+}
+
+func (u Users) userIDs(query string, args ...interface{}) ([]int64, error) {
+	rows, err := u.rbac.reader().Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []int64
+	for rows.Next() {
+		var id int64
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, id)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
 func (u Users) getTable() string {
 	return u.table
 }
@@ -222,16 +608,20 @@ func (u Users) ResetAssignments(ensure bool) error {
 	}
 
 	var err error
-	_, err = u.rbac.db.Exec("DELETE FROM user_roles")
+	_, err = u.rbac.db.Exec(fmt.Sprintf("DELETE FROM %s", u.getTable()))
 	if err != nil {
 		return err
 	}
-	_, err = u.rbac.db.Exec("ALTER TABLE user_roles AUTO_INCREMENT =1")
+	_, err = u.rbac.db.Exec(fmt.Sprintf("ALTER TABLE %s AUTO_INCREMENT =1", u.getTable()))
 	if err != nil {
 		return err
 	}
 
-	u.Assign("root", u.rbac.rootID(), nil)
+	if !u.rbac.seedRoot {
+		return nil
+	}
+
+	_, err = u.Assign(u.rbac.rootID(), u.rbac.rootID(), nil)
 
-	return nil
+	return err
 }